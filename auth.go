@@ -0,0 +1,369 @@
+package smtp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// SASL mechanisms not defined by go-sasl.
+const (
+	CRAMMD5 = "CRAM-MD5"
+	XOAuth2 = "XOAUTH2"
+)
+
+// Credentials are used by Client.Authenticate to select a SASL mechanism.
+type Credentials struct {
+	Username string
+	Password string
+	// Token is an OAuth 2.0 bearer token. If set, OAUTHBEARER and XOAUTH2
+	// are used instead of the password.
+	Token string
+	// AllowInsecure allows credentials to be sent in cleartext over
+	// connections without TLS, with mechanisms such as PLAIN and LOGIN.
+	AllowInsecure bool
+}
+
+// authMechanism describes a SASL mechanism which can be selected
+// automatically.
+type authMechanism struct {
+	name string
+	// cleartext is true if the mechanism exposes the credentials to
+	// eavesdroppers.
+	cleartext bool
+	// token is true if the mechanism uses Credentials.Token instead of
+	// Credentials.Password.
+	token     bool
+	newClient func(creds *Credentials) sasl.Client
+}
+
+// authMechanisms lists the mechanisms supported by Client.Authenticate, from
+// the strongest to the weakest.
+var authMechanisms = []authMechanism{
+	{name: sasl.OAuthBearer, cleartext: true, token: true, newClient: func(creds *Credentials) sasl.Client {
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: creds.Username,
+			Token:    creds.Token,
+		})
+	}},
+	{name: XOAuth2, cleartext: true, token: true, newClient: func(creds *Credentials) sasl.Client {
+		return &xoauth2Client{creds.Username, creds.Token}
+	}},
+	{name: SCRAMSHA256, newClient: func(creds *Credentials) sasl.Client {
+		return newSCRAMClient(SCRAMSHA256, creds.Username, creds.Password)
+	}},
+	{name: SCRAMSHA1, newClient: func(creds *Credentials) sasl.Client {
+		return newSCRAMClient(SCRAMSHA1, creds.Username, creds.Password)
+	}},
+	{name: CRAMMD5, newClient: func(creds *Credentials) sasl.Client {
+		return &cramMD5Client{creds.Username, creds.Password}
+	}},
+	{name: sasl.Plain, cleartext: true, newClient: func(creds *Credentials) sasl.Client {
+		return sasl.NewPlainClient("", creds.Username, creds.Password)
+	}},
+	{name: sasl.Login, cleartext: true, newClient: func(creds *Credentials) sasl.Client {
+		return sasl.NewLoginClient(creds.Username, creds.Password)
+	}},
+}
+
+// Authenticate authenticates a client with the strongest SASL mechanism
+// supported by both the client and the server: OAUTHBEARER and XOAUTH2 if a
+// token is provided, otherwise SCRAM-SHA-256, SCRAM-SHA-1, CRAM-MD5, PLAIN
+// and LOGIN. If the server replies that a mechanism isn't supported, the next
+// one is tried.
+//
+// Mechanisms sending credentials in cleartext are only used over TLS, unless
+// creds.AllowInsecure is set.
+//
+// If server returns an error, it will be of type *SMTPError.
+func (c *Client) Authenticate(creds *Credentials) error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	if _, ok := c.ext["AUTH"]; !ok {
+		return errors.New("smtp: server doesn't support AUTH")
+	}
+
+	supported := make(map[string]bool)
+	for _, mech := range c.auth {
+		supported[strings.ToUpper(mech)] = true
+	}
+
+	var err error = errors.New("smtp: no usable authentication mechanism")
+	for _, mech := range authMechanisms {
+		if !supported[mech.name] || mech.token != (creds.Token != "") {
+			continue
+		}
+		if mech.cleartext && !c.tls && !creds.AllowInsecure {
+			continue
+		}
+
+		err = c.Auth(mech.newClient(creds))
+		if smtpErr, ok := err.(*SMTPError); ok && smtpErr.Code == 504 {
+			// Mechanism not supported, try the next one
+			continue
+		}
+		return err
+	}
+	return err
+}
+
+// AuthenticateContext is like Authenticate, but uses ctx for the
+// authentication exchange.
+func (c *Client) AuthenticateContext(ctx context.Context, creds *Credentials) error {
+	return c.withContext(ctx, func() error {
+		return c.Authenticate(creds)
+	})
+}
+
+// cramMD5Client implements the CRAM-MD5 mechanism, as defined in RFC 2195.
+type cramMD5Client struct {
+	username, password string
+}
+
+func (a *cramMD5Client) Start() (mech string, ir []byte, err error) {
+	return CRAMMD5, nil, nil
+}
+
+func (a *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	mac := hmac.New(md5.New, []byte(a.password))
+	mac.Write(challenge)
+	return []byte(a.username + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// xoauth2Client implements the XOAUTH2 mechanism.
+type xoauth2Client struct {
+	username, token string
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01")
+	return XOAuth2, ir, nil
+}
+
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// The server sends an error as challenge, and expects an empty response
+	// before failing the exchange
+	return []byte{}, nil
+}
+
+// passwordLogin authenticates a client using the PLAIN or LOGIN mechanism.
+func passwordLogin(conn *Conn, be Backend, mech, identity, username, password string) error {
+	state := conn.State()
+	var session Session
+	var err error
+	if authzBe, ok := be.(AuthzBackend); ok {
+		session, err = authzBe.AuthzLogin(&state, mech, identity, username, password)
+	} else if err := checkIdentity(be, identity, username); err != nil {
+		return err
+	} else {
+		session, err = be.Login(&state, username, password)
+	}
+	if err != nil {
+		return err
+	}
+	conn.login(session, mech, username, identity)
+	return nil
+}
+
+// checkIdentity rejects clients requesting an authorization identity other
+// than username, unless the backend implements AuthzBackend.
+func checkIdentity(be interface{}, identity, username string) error {
+	if _, ok := be.(AuthzBackend); ok {
+		return nil
+	}
+	if identity != "" && identity != username {
+		return errors.New("Identities not supported")
+	}
+	return nil
+}
+
+func newPlainServer(conn *Conn, be Backend) sasl.Server {
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		return passwordLogin(conn, be, sasl.Plain, identity, username, password)
+	})
+}
+
+func newLoginServer(conn *Conn, be Backend) sasl.Server {
+	return sasl.NewLoginServer(func(username, password string) error {
+		return passwordLogin(conn, be, sasl.Login, "", username, password)
+	})
+}
+
+type cramMD5Server struct {
+	conn      *Conn
+	be        CRAMMD5Backend
+	challenge []byte
+}
+
+func newCRAMMD5Server(conn *Conn, be CRAMMD5Backend) sasl.Server {
+	return &cramMD5Server{conn: conn, be: be}
+}
+
+func (s *cramMD5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if s.challenge == nil {
+		if len(response) > 0 {
+			return nil, false, sasl.ErrUnexpectedClientResponse
+		}
+		nonce, err := scramNonce()
+		if err != nil {
+			return nil, false, err
+		}
+		domain := s.conn.server.Domain
+		if domain == "" {
+			domain = "localhost"
+		}
+		s.challenge = []byte(fmt.Sprintf("<%s.%d@%s>", nonce, time.Now().Unix(), domain))
+		return s.challenge, false, nil
+	}
+
+	parts := strings.Split(string(response), " ")
+	if len(parts) != 2 {
+		return nil, true, errors.New("Invalid CRAM-MD5 response")
+	}
+	username := parts[0]
+	digest, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, true, errors.New("Invalid CRAM-MD5 response")
+	}
+
+	state := s.conn.State()
+	secret, err := s.be.CRAMMD5Secret(&state, username)
+	if err != nil {
+		return nil, true, err
+	}
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write(s.challenge)
+	if !hmac.Equal(mac.Sum(nil), digest) {
+		return nil, true, ErrAuthFailed
+	}
+
+	session, err := s.be.SecretLogin(&state, CRAMMD5, "", username)
+	if err != nil {
+		return nil, true, err
+	}
+	s.conn.login(session, CRAMMD5, username, "")
+	return nil, true, nil
+}
+
+// oauthBearerServer wraps the OAUTHBEARER server of go-sasl to report the
+// error returned by the backend once the exchange fails.
+type oauthBearerServer struct {
+	sasl.Server
+	started bool
+	err     error
+}
+
+func newOAuthBearerServer(conn *Conn, be TokenBackend) sasl.Server {
+	s := &oauthBearerServer{}
+	s.Server = sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+		state := conn.State()
+		session, err := be.TokenLogin(&state, opts.Username, opts.Token)
+		if err != nil {
+			s.err = err
+			return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+		}
+		conn.login(session, sasl.OAuthBearer, opts.Username, "")
+		return nil
+	})
+	return s
+}
+
+func (s *oauthBearerServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if s.started {
+		// The exchange failed and the client acknowledged the error
+		if s.err != nil {
+			return nil, true, s.err
+		}
+		return nil, true, ErrAuthFailed
+	}
+	if response != nil {
+		s.started = true
+	}
+	return s.Server.Next(response)
+}
+
+type xoauth2Server struct {
+	conn *Conn
+	be   TokenBackend
+	err  error
+}
+
+func newXOAuth2Server(conn *Conn, be TokenBackend) sasl.Server {
+	return &xoauth2Server{conn: conn, be: be}
+}
+
+func (s *xoauth2Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if s.err != nil {
+		// The client acknowledged the error
+		return nil, true, s.err
+	}
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	var username, token string
+	for _, field := range strings.Split(string(response), "\x01") {
+		if strings.HasPrefix(field, "user=") {
+			username = strings.TrimPrefix(field, "user=")
+		} else if strings.HasPrefix(strings.ToLower(field), "auth=bearer ") {
+			token = field[len("auth=bearer "):]
+		}
+	}
+	if username == "" || token == "" {
+		return nil, true, errors.New("Invalid XOAUTH2 response")
+	}
+
+	state := s.conn.State()
+	session, err := s.be.TokenLogin(&state, username, token)
+	if err != nil {
+		// The error is sent as a challenge, the exchange fails once the
+		// client sends an empty response
+		s.err = err
+		return []byte(`{"status":"401","schemes":"bearer"}`), false, nil
+	}
+	s.conn.login(session, XOAuth2, username, "")
+	return nil, true, nil
+}
+
+type externalServer struct {
+	conn    *Conn
+	be      ExternalBackend
+	started bool
+}
+
+func newExternalServer(conn *Conn, be ExternalBackend) sasl.Server {
+	return &externalServer{conn: conn, be: be}
+}
+
+func (s *externalServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if response == nil && !s.started {
+		// Ask for the authorization identity
+		s.started = true
+		return []byte{}, false, nil
+	}
+
+	state := s.conn.State()
+	if len(state.TLS.VerifiedChains) == 0 {
+		return nil, true, ErrAuthFailed
+	}
+	cert := state.TLS.VerifiedChains[0][0]
+	// Only the backend knows the identity of the certificate
+	identity := string(response)
+	if err := checkIdentity(s.be, identity, ""); err != nil {
+		return nil, true, err
+	}
+	session, err := s.be.ExternalLogin(&state, identity, cert)
+	if err != nil {
+		return nil, true, err
+	}
+	s.conn.login(session, sasl.External, "", identity)
+	return nil, true, nil
+}
@@ -1,6 +1,8 @@
 package smtp
 
 import (
+	"context"
+	"crypto/x509"
 	"io"
 )
 
@@ -15,6 +17,11 @@ var (
 		EnhancedCode: EnhancedCode{5, 7, 0},
 		Message:      "Authentication not supported",
 	}
+	ErrAuthFailed = &SMTPError{
+		Code:         535,
+		EnhancedCode: EnhancedCode{5, 7, 8},
+		Message:      "Authentication credentials invalid",
+	}
 )
 
 // A SMTP server backend.
@@ -28,6 +35,110 @@ type Backend interface {
 	AnonymousLogin(state *ConnectionState) (Session, error)
 }
 
+// ConnectBackend is an add-on interface for Backend. It can be implemented by
+// backends which need to accept or reject clients before the greeting.
+type ConnectBackend interface {
+	// Connect is called when a client connects, before the 220 greeting is
+	// sent. It is called again after a successful XCLIENT command.
+	//
+	// If an error is returned, the client is rejected instead of being
+	// greeted and the connection is closed. An *SMTPError is sent as is, e.g.
+	// with code 554 or 421. Other errors are logged and replaced with a
+	// generic 554 reply. If banner is not empty, it replaces the text of the
+	// greeting.
+	Connect(state *ConnectionState) (banner string, err error)
+}
+
+// HelloBackend is an add-on interface for Backend. It can be implemented by
+// backends which need to validate the domain given by clients or to tailor
+// the capabilities advertised to them.
+type HelloBackend interface {
+	// Hello is called on HELO, EHLO and LHLO with the domain or address
+	// literal given by the client. An error rejects the command; an
+	// *SMTPError can be used to control the reply.
+	//
+	// For EHLO and LHLO, caps contains the capabilities that would be
+	// advertised, e.g. "SIZE 1024". The returned list is advertised instead,
+	// so capabilities can be added or removed. If AUTH is removed, the AUTH
+	// command is rejected until the session is reset by STARTTLS, even if
+	// the client sends HELO. Other capabilities are not enforced by the
+	// server. For HELO, caps is nil.
+	Hello(state *ConnectionState, domain string, caps []string) ([]string, error)
+}
+
+// AuthzBackend is an add-on interface for Backend. It can be implemented by
+// backends allowing users to act as another identity, e.g. to send mail as a
+// shared mailbox.
+//
+// If implemented, AuthzLogin is called instead of Login for the PLAIN and
+// LOGIN mechanisms, and the other mechanisms pass any identity requested by
+// the client to the backend. Otherwise, clients requesting an identity other
+// than their username are rejected by all mechanisms.
+type AuthzBackend interface {
+	// AuthzLogin authenticates a user with a password for mech. identity is
+	// the authorization identity requested by the client, empty if the
+	// client wants to act as username. The backend must check that username
+	// may act as identity.
+	AuthzLogin(state *ConnectionState, mech, identity, username, password string) (Session, error)
+}
+
+// TokenBackend is an add-on interface for Backend. It can be implemented by
+// backends accepting OAuth 2.0 bearer tokens, to enable the OAUTHBEARER
+// (RFC 7628) and XOAUTH2 mechanisms.
+type TokenBackend interface {
+	// TokenLogin authenticates a user with a bearer token.
+	TokenLogin(state *ConnectionState, username, token string) (Session, error)
+}
+
+// SecretBackend creates sessions for users authenticated with a
+// challenge-response mechanism. Such mechanisms verify the client response
+// against a secret looked up in the backend, the password is never sent.
+type SecretBackend interface {
+	// SecretLogin is called once the user has been authenticated with mech.
+	// identity is the authorization identity requested by the client, empty
+	// if the client wants to act as username. If the backend implements
+	// AuthzBackend, it must check that username may act as identity.
+	// Otherwise, identity is either empty or username.
+	SecretLogin(state *ConnectionState, mech, identity, username string) (Session, error)
+}
+
+// CRAMMD5Backend is an add-on interface for Backend. It can be implemented by
+// backends with access to the passwords of users, to enable the CRAM-MD5
+// mechanism (RFC 2195).
+type CRAMMD5Backend interface {
+	SecretBackend
+
+	// CRAMMD5Secret returns the password of a user.
+	CRAMMD5Secret(state *ConnectionState, username string) (string, error)
+}
+
+// SCRAMBackend is an add-on interface for Backend. It can be implemented by
+// backends storing salted credentials, to enable the SCRAM-SHA-1 and
+// SCRAM-SHA-256 mechanisms (RFC 5802, RFC 7677).
+type SCRAMBackend interface {
+	SecretBackend
+
+	// SCRAMSecret returns the credentials of a user for mech, SCRAMSHA1 or
+	// SCRAMSHA256. Credentials can be created with NewSCRAMCredentials.
+	SCRAMSecret(state *ConnectionState, mech, username string) (*SCRAMCredentials, error)
+}
+
+// ExternalBackend is an add-on interface for Backend. It can be implemented by
+// backends authenticating clients with TLS certificates, to enable the
+// EXTERNAL mechanism (RFC 4422 appendix A).
+//
+// EXTERNAL is only advertised to clients which sent a certificate verified
+// by the server. Server.TLSConfig.ClientAuth must be set accordingly, e.g. to
+// tls.VerifyClientCertIfGiven.
+type ExternalBackend interface {
+	// ExternalLogin authenticates a client with its certificate, the leaf
+	// of its first verified chain. identity is the authorization identity
+	// requested by the client, empty if the client wants to act as the
+	// identity of the certificate. It is always empty unless the backend
+	// implements AuthzBackend.
+	ExternalLogin(state *ConnectionState, identity string, cert *x509.Certificate) (Session, error)
+}
+
 type BodyType string
 
 const (
@@ -36,6 +147,15 @@ const (
 	BodyBinaryMIME BodyType = "BINARYMIME"
 )
 
+// DSNReturn is the value of the RET= argument of the MAIL command, as
+// defined in RFC 3461.
+type DSNReturn string
+
+const (
+	DSNReturnFull    DSNReturn = "FULL"
+	DSNReturnHeaders DSNReturn = "HDRS"
+)
+
 // MailOptions contains custom arguments that were
 // passed as an argument to the MAIL command.
 type MailOptions struct {
@@ -63,6 +183,61 @@ type MailOptions struct {
 	//
 	// Defined in RFC 4954.
 	Auth *string
+
+	// Value of RET= argument, FULL or HDRS. Empty if not specified.
+	//
+	// Defined in RFC 3461.
+	Return DSNReturn
+
+	// Envelope identifier, in decoded form. Empty if not specified.
+	//
+	// Defined in RFC 3461.
+	EnvelopeID string
+
+	// Values of parameters registered with Server.EnableMailParam, indexed
+	// by uppercase parameter name. nil if none was specified.
+	Extensions map[string]string
+}
+
+// DSNNotify is a value of the NOTIFY= argument of the RCPT command, as
+// defined in RFC 3461.
+type DSNNotify string
+
+const (
+	DSNNotifyNever   DSNNotify = "NEVER"
+	DSNNotifyDelayed DSNNotify = "DELAY"
+	DSNNotifyFailure DSNNotify = "FAILURE"
+	DSNNotifySuccess DSNNotify = "SUCCESS"
+)
+
+// DSNAddressType is the address type of the ORCPT= argument of the RCPT
+// command, as defined in RFC 3461.
+type DSNAddressType string
+
+const (
+	DSNAddressTypeRFC822 DSNAddressType = "RFC822"
+	DSNAddressTypeUTF8   DSNAddressType = "UTF-8"
+)
+
+// RcptOptions contains custom arguments that were
+// passed as an argument to the RCPT command.
+type RcptOptions struct {
+	// Value of NOTIFY= argument, NEVER or a combination of SUCCESS, FAILURE
+	// and DELAY. Empty if not specified.
+	//
+	// Defined in RFC 3461.
+	Notify []DSNNotify
+
+	// Original recipient set by client, in decoded form, and its address
+	// type. Empty if not specified.
+	//
+	// Defined in RFC 3461.
+	OriginalRecipientType DSNAddressType
+	OriginalRecipient     string
+
+	// Values of parameters registered with Server.EnableRcptParam, indexed
+	// by uppercase parameter name. nil if none was specified.
+	Extensions map[string]string
 }
 
 // Session is used by servers to respond to an SMTP client.
@@ -85,6 +260,51 @@ type Session interface {
 	Data(r io.Reader) error
 }
 
+// ContextSession is an add-on interface for Session. It can be implemented by
+// backends which need to abort work when the client goes away.
+//
+// If implemented, its methods are called instead of Mail, Rcpt and Data. The
+// passed context is cancelled when the mail transaction is reset (including
+// by RSET and QUIT), when the connection is closed and when the server is
+// closed.
+type ContextSession interface {
+	// MailContext is the context-aware version of Mail.
+	MailContext(ctx context.Context, from string, opts *MailOptions) error
+	// RcptContext is the context-aware version of Rcpt, receiving the
+	// arguments of the RCPT command like RcptOptionsSession.
+	RcptContext(ctx context.Context, to string, opts *RcptOptions) error
+	// DataContext is the context-aware version of Data.
+	DataContext(ctx context.Context, r io.Reader) error
+}
+
+// RcptOptionsSession is an add-on interface for Session. It can be
+// implemented by backends which need the arguments of the RCPT command.
+type RcptOptionsSession interface {
+	// RcptWithOptions is called instead of Rcpt.
+	RcptWithOptions(to string, opts *RcptOptions) error
+}
+
+// VerifySession is an add-on interface for Session. It can be implemented by
+// backends which answer the VRFY command. Without it, VRFY is answered with
+// a 252 reply.
+type VerifySession interface {
+	// Verify returns the mailboxes matching the user name or address given
+	// to VRFY, e.g. "Jane Doe <jane@example.org>". An *SMTPError can be
+	// returned to reject the request, e.g. with code 550 if the user is
+	// unknown or 553 if it is ambiguous.
+	Verify(addr string) ([]string, error)
+}
+
+// ExpandSession is an add-on interface for Session. It can be implemented by
+// backends which answer the EXPN command. Without it, EXPN is not
+// implemented.
+type ExpandSession interface {
+	// Expand returns the members of the mailing list given to EXPN. An
+	// *SMTPError can be returned to reject the request, e.g. with code 550
+	// if the list is unknown.
+	Expand(list string) ([]string, error)
+}
+
 // LMTPSession is an add-on interface for Session. It can be implemented by
 // LMTP servers to provide extra functionality.
 type LMTPSession interface {
@@ -0,0 +1,114 @@
+package backendutil
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Resolver performs DNS lookups. It is implemented by *net.Resolver.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// HelloChecker validates the domain given by clients in HELO, EHLO and LHLO.
+// It can be used to implement smtp.HelloBackend.
+type HelloChecker struct {
+	// Accept address literals, e.g. "[192.0.2.1]". Bare IP addresses are
+	// always rejected.
+	AllowAddressLiterals bool
+	// Domains of this server. Clients using one of them are rejected.
+	LocalDomains []string
+	// If set, the domain must be a forward-confirmed reverse DNS name of the
+	// client IP address.
+	Resolver Resolver
+}
+
+// Check checks the domain given by the client. The returned error, if any,
+// is an *smtp.SMTPError.
+func (hc *HelloChecker) Check(ctx context.Context, state *smtp.ConnectionState, domain string) error {
+	if strings.HasPrefix(domain, "[") {
+		if !hc.AllowAddressLiterals {
+			return helloRejected("Address literals are not accepted")
+		}
+		return nil
+	}
+	if net.ParseIP(domain) != nil {
+		return helloRejected("Need fully-qualified hostname")
+	}
+
+	domain = strings.TrimSuffix(domain, ".")
+	for _, local := range hc.LocalDomains {
+		if strings.EqualFold(domain, strings.TrimSuffix(local, ".")) {
+			return helloRejected("You are not me")
+		}
+	}
+
+	if hc.Resolver == nil {
+		return nil
+	}
+	tcpAddr, ok := state.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	names, err := ForwardConfirmedNames(ctx, hc.Resolver, tcpAddr.IP)
+	if err != nil {
+		return &smtp.SMTPError{
+			Code:         450,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 3},
+			Message:      "Temporary DNS failure",
+		}
+	}
+	for _, name := range names {
+		if strings.EqualFold(domain, name) {
+			return nil
+		}
+	}
+	return helloRejected("Hostname does not match reverse DNS")
+}
+
+// ForwardConfirmedNames returns the reverse DNS names of ip which resolve
+// back to ip, without trailing dots. Names which don't exist are ignored.
+func ForwardConfirmedNames(ctx context.Context, r Resolver, ip net.IP) ([]string, error) {
+	names, err := r.LookupAddr(ctx, ip.String())
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var confirmed []string
+	for _, name := range names {
+		addrs, err := r.LookupIPAddr(ctx, name)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				confirmed = append(confirmed, strings.TrimSuffix(name, "."))
+				break
+			}
+		}
+	}
+	return confirmed, nil
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func helloRejected(msg string) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Helo command rejected: " + msg,
+	}
+}
@@ -0,0 +1,80 @@
+package backendutil_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+type resolver struct {
+	names map[string][]string
+	addrs map[string][]net.IPAddr
+}
+
+func (r *resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	names, ok := r.names[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return names, nil
+}
+
+func (r *resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if host == "broken.example.org." {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestHelloChecker(t *testing.T) {
+	hc := &backendutil.HelloChecker{
+		LocalDomains: []string{"mx.example.com"},
+		Resolver: &resolver{
+			names: map[string][]string{
+				"192.0.2.1": {"spoofed.example.org.", "mail.example.org."},
+				"192.0.2.2": {"broken.example.org."},
+			},
+			addrs: map[string][]net.IPAddr{
+				"spoofed.example.org.": {{IP: net.ParseIP("198.51.100.1")}},
+				"mail.example.org.":    {{IP: net.ParseIP("192.0.2.1")}},
+			},
+		},
+	}
+
+	tests := []struct {
+		ip     string
+		domain string
+		code   int
+	}{
+		{"192.0.2.1", "mail.example.org", 0},
+		{"192.0.2.1", "MAIL.example.org.", 0},
+		{"192.0.2.1", "spoofed.example.org", 550},
+		{"192.0.2.1", "192.0.2.1", 550},
+		{"192.0.2.1", "[192.0.2.1]", 550},
+		{"192.0.2.1", "mx.example.com", 550},
+		{"192.0.2.2", "broken.example.org", 450},
+		{"192.0.2.3", "unknown.example.org", 550},
+	}
+	for _, test := range tests {
+		state := &smtp.ConnectionState{
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(test.ip), Port: 25},
+		}
+		err := hc.Check(context.Background(), state, test.domain)
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("Check(%v, %q) = %v; want nil", test.ip, test.domain, err)
+			}
+			continue
+		}
+		if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != test.code {
+			t.Errorf("Check(%v, %q) = %v; want code %v", test.ip, test.domain, err, test.code)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package backendutil
 
 import (
+	"context"
 	"io"
 
 	"github.com/emersion/go-smtp"
@@ -33,6 +34,22 @@ func (be *TransformBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Se
 	return &transformSession{s, be}, nil
 }
 
+// Connect implements the smtp.ConnectBackend interface.
+func (be *TransformBackend) Connect(state *smtp.ConnectionState) (string, error) {
+	if cb, ok := be.Backend.(smtp.ConnectBackend); ok {
+		return cb.Connect(state)
+	}
+	return "", nil
+}
+
+// Hello implements the smtp.HelloBackend interface.
+func (be *TransformBackend) Hello(state *smtp.ConnectionState, domain string, caps []string) ([]string, error) {
+	if hb, ok := be.Backend.(smtp.HelloBackend); ok {
+		return hb.Hello(state, domain, caps)
+	}
+	return caps, nil
+}
+
 type transformSession struct {
 	Session smtp.Session
 
@@ -65,6 +82,21 @@ func (s *transformSession) Rcpt(to string) error {
 	return s.Session.Rcpt(to)
 }
 
+func (s *transformSession) RcptWithOptions(to string, opts *smtp.RcptOptions) error {
+	rs, ok := s.Session.(smtp.RcptOptionsSession)
+	if !ok {
+		return s.Rcpt(to)
+	}
+	if s.be.TransformRcpt != nil {
+		var err error
+		to, err = s.be.TransformRcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	return rs.RcptWithOptions(to, opts)
+}
+
 func (s *transformSession) Data(r io.Reader) error {
 	if s.be.TransformData != nil {
 		var err error
@@ -76,6 +108,54 @@ func (s *transformSession) Data(r io.Reader) error {
 	return s.Session.Data(r)
 }
 
+// MailContext implements the smtp.ContextSession interface.
+func (s *transformSession) MailContext(ctx context.Context, from string, opts *smtp.MailOptions) error {
+	cs, ok := s.Session.(smtp.ContextSession)
+	if !ok {
+		return s.Mail(from, opts)
+	}
+	if s.be.TransformMail != nil {
+		var err error
+		from, err = s.be.TransformMail(from)
+		if err != nil {
+			return err
+		}
+	}
+	return cs.MailContext(ctx, from, opts)
+}
+
+// RcptContext implements the smtp.ContextSession interface.
+func (s *transformSession) RcptContext(ctx context.Context, to string, opts *smtp.RcptOptions) error {
+	cs, ok := s.Session.(smtp.ContextSession)
+	if !ok {
+		return s.RcptWithOptions(to, opts)
+	}
+	if s.be.TransformRcpt != nil {
+		var err error
+		to, err = s.be.TransformRcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	return cs.RcptContext(ctx, to, opts)
+}
+
+// DataContext implements the smtp.ContextSession interface.
+func (s *transformSession) DataContext(ctx context.Context, r io.Reader) error {
+	cs, ok := s.Session.(smtp.ContextSession)
+	if !ok {
+		return s.Data(r)
+	}
+	if s.be.TransformData != nil {
+		var err error
+		r, err = s.be.TransformData(r)
+		if err != nil {
+			return err
+		}
+	}
+	return cs.DataContext(ctx, r)
+}
+
 func (s *transformSession) Logout() error {
 	return s.Session.Logout()
 }
@@ -2,6 +2,7 @@ package backendutil_test
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
 	"errors"
 	"io"
@@ -27,6 +28,9 @@ type backend struct {
 	anonmsgs []*message
 
 	userErr error
+
+	implementContext bool
+	contextCalls     int
 }
 
 func (be *backend) Login(_ *smtp.ConnectionState, username, password string) (smtp.Session, error) {
@@ -37,6 +41,9 @@ func (be *backend) Login(_ *smtp.ConnectionState, username, password string) (sm
 	if username != "username" || password != "password" {
 		return nil, errors.New("Invalid username or password")
 	}
+	if be.implementContext {
+		return &contextSession{&session{backend: be}}, nil
+	}
 	return &session{backend: be}, nil
 }
 
@@ -88,6 +95,25 @@ func (s *session) Data(r io.Reader) error {
 	return nil
 }
 
+type contextSession struct {
+	*session
+}
+
+func (s *contextSession) MailContext(ctx context.Context, from string, opts *smtp.MailOptions) error {
+	s.backend.contextCalls++
+	return s.Mail(from, opts)
+}
+
+func (s *contextSession) RcptContext(ctx context.Context, to string, opts *smtp.RcptOptions) error {
+	s.backend.contextCalls++
+	return s.Rcpt(to)
+}
+
+func (s *contextSession) DataContext(ctx context.Context, r io.Reader) error {
+	s.backend.contextCalls++
+	return s.Data(r)
+}
+
 type serverConfigureFunc func(*smtp.Server)
 
 func transformMailString(s string) (string, error) {
@@ -186,8 +212,8 @@ func testServerEhlo(t *testing.T, fn ...serverConfigureFunc) (be *backend, s *sm
 	return
 }
 
-func testServerAuthenticated(t *testing.T) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
-	be, s, c, scanner, caps := testServerEhlo(t)
+func testServerAuthenticated(t *testing.T, fn ...serverConfigureFunc) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
+	be, s, c, scanner, caps := testServerEhlo(t, fn...)
 
 	if _, ok := caps["AUTH PLAIN"]; !ok {
 		t.Fatal("AUTH PLAIN capability is missing when auth is enabled")
@@ -257,6 +283,37 @@ func TestServer(t *testing.T) {
 	}
 }
 
+func TestServer_contextSession(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.Backend.(*backendutil.TransformBackend).Backend.(*backend).implementContext = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if be.contextCalls != 3 {
+		t.Fatal("Invalid number of ContextSession calls:", be.contextCalls)
+	}
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+	msg := be.messages[0]
+	if msg.From != "cm9vdEBuc2EuZ292" || len(msg.To) != 1 || msg.To[0] != "cm9vdEBnY2hxLmdvdi51aw==" || string(msg.Data) != "SGV5IDwzDQo=" {
+		t.Fatal("Invalid message:", msg)
+	}
+}
+
 func TestServer_tooLongMessage(t *testing.T) {
 	be, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -5,8 +5,10 @@
 package smtp
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -42,24 +44,78 @@ type Client struct {
 	didHello   bool     // whether we've said HELO/EHLO/LHLO
 	helloError error    // the error from the hello
 	rcpts      []string // recipients accumulated for the current session
+	binaryMIME bool     // whether the current transaction uses BODY=BINARYMIME
+	inData     bool     // whether message data is being sent after DATA
+
+	// TLSPolicy controls whether STARTTLS is sent automatically after the
+	// first EHLO. With TLSPolicyNone, StartTLS must be called explicitly.
+	TLSPolicy TLSPolicy
+	// TLSConfig is used when starting TLS because of TLSPolicy. A nil config
+	// is equivalent to a zero tls.Config.
+	TLSConfig *tls.Config
+	// DANE, if set, enables the verification of the server certificate
+	// against its TLSA records when starting TLS.
+	DANE *DANE
 
 	// Time to wait for command responses (this includes 3xx reply to DATA).
 	CommandTimeout time.Duration
 	// Time to wait for responses after final dot.
 	SubmissionTimeout time.Duration
 
+	// Size of the chunks sent with BDAT when the server supports the CHUNKING
+	// extension (RFC 3030). If zero, chunks of 1 MiB are used.
+	ChunkSize int
+
 	// Logger for all network activity.
 	DebugWriter io.Writer
+
+	// Deadline of the context of the current operation, if any, and whether
+	// that context is done
+	deadlineMu  sync.Mutex
+	ctxDeadline time.Time
+	ctxDone     bool
+
+	// Whether the server certificate has been verified by an opportunistic
+	// STARTTLS, or why it couldn't be
+	tlsVerified  bool
+	tlsVerifyErr error
+	// Usable TLSA records of the server, whether DANE requires TLS, and the
+	// record matching the certificate
+	tlsaLookedUp bool
+	tlsaRecords  []TLSA
+	tlsaRequired bool
+	tlsaMatch    *TLSA
 }
 
+// TLSPolicy controls how a Client uses STARTTLS.
+type TLSPolicy int
+
+const (
+	// TLSPolicyNone doesn't start TLS automatically.
+	TLSPolicyNone TLSPolicy = iota
+	// TLSPolicyOpportunistic starts TLS if the server supports STARTTLS.
+	// Invalid certificates are accepted, see TLSReport.Verified. If the
+	// server rejects the STARTTLS command, the session continues in
+	// cleartext. A failed TLS handshake closes the connection.
+	TLSPolicyOpportunistic
+	// TLSPolicyRequired fails if the server doesn't support STARTTLS or if
+	// the TLS handshake fails.
+	TLSPolicyRequired
+)
+
 const (
 	// 30 seconds was chosen as it's the
 	// same duration as http.DefaultTransport's timeout.
 	defaultTimeout = 30 * time.Second
 	// Doubled maximum line length per RFC 5321 (Section 4.5.3.1.6)
 	maxLineLimit = 2000
+	// Default size of BDAT chunks.
+	defaultChunkSize = 1024 * 1024
 )
 
+// aLongTimeAgo is a deadline used to interrupt pending I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
 // Dial returns a new Client connected to an SMTP server at addr.
 // The addr must include a port, as in "mail.example.com:smtp".
 func Dial(addr string) (*Client, error) {
@@ -76,13 +132,8 @@ func Dial(addr string) (*Client, error) {
 //
 // A nil tlsConfig is equivalent to a zero tls.Config.
 func DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
-	tlsDialer := tls.Dialer{
-		NetDialer: &net.Dialer{
-			Timeout: defaultTimeout,
-		},
-		Config: tlsConfig,
-	}
-	conn, err := tlsDialer.Dial("tcp", addr)
+	netDialer := &net.Dialer{Timeout: defaultTimeout}
+	conn, err := tls.DialWithDialer(netDialer, "tcp", addr, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -90,10 +141,168 @@ func DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
 	return NewClient(conn, host)
 }
 
+// ContextDialer dials network connections. It is implemented by *net.Dialer
+// and by the dialers of golang.org/x/net/proxy.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// A Dialer dials SMTP servers with a context.
+type Dialer struct {
+	// NetDialer is used to open the network connections. If nil, a
+	// net.Dialer with a default timeout is used.
+	NetDialer ContextDialer
+
+	// TLSPolicy and TLSConfig are set on the clients returned by DialContext.
+	// See Client.TLSPolicy.
+	TLSPolicy TLSPolicy
+	TLSConfig *tls.Config
+	// DANE is set on the returned clients, and used to verify the server
+	// certificate in DialTLSContext. See Client.DANE.
+	DANE *DANE
+}
+
+func (d *Dialer) netDialer() ContextDialer {
+	if d.NetDialer != nil {
+		return d.NetDialer
+	}
+	return &net.Dialer{Timeout: defaultTimeout}
+}
+
+// DialContext is like Dial, but uses ctx for dialing and for reading the
+// server greeting.
+func (d *Dialer) DialContext(ctx context.Context, addr string) (*Client, error) {
+	conn, err := d.netDialer().DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := NewClientContext(ctx, conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.TLSPolicy = d.TLSPolicy
+	c.TLSConfig = d.TLSConfig
+	c.DANE = d.DANE
+	return c, nil
+}
+
+// DialTLSContext is like DialTLS, but uses ctx for dialing, for the TLS
+// handshake and for reading the server greeting.
+func (d *Dialer) DialTLSContext(ctx context.Context, addr string, tlsConfig *tls.Config) (*Client, error) {
+	conn, err := d.netDialer().DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	// Make a copy to avoid polluting argument
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+
+	var (
+		records  []TLSA
+		required bool
+		match    *TLSA
+	)
+	if d.DANE != nil {
+		records, required, err = d.DANE.lookup(ctx, tlsConfig.ServerName)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if len(records) > 0 {
+		setDANEVerification(tlsConfig, records, func(r *TLSA) {
+			match = r
+		})
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsHandshake(ctx, tlsConn); err != nil {
+		conn.Close()
+		return nil, daneHandshakeError(err, tlsConfig.ServerName, required)
+	}
+
+	c, err := NewClientContext(ctx, tlsConn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.DANE = d.DANE
+	c.tlsaLookedUp = d.DANE != nil
+	c.tlsaRecords = records
+	c.tlsaRequired = required
+	c.tlsaMatch = match
+	c.tlsVerified = match != nil
+	return c, nil
+}
+
+// tlsHandshake runs the TLS handshake of conn, which is interrupted if ctx is
+// done.
+func tlsHandshake(ctx context.Context, conn *tls.Conn) error {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+
+	err := conn.Handshake()
+	close(stop)
+	<-stopped
+	conn.SetDeadline(time.Time{})
+
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return fmt.Errorf("smtp: %w", ctxErr)
+	}
+	return err
+}
+
+// DialContext is like Dial, but uses ctx for dialing and for reading the
+// server greeting.
+func DialContext(ctx context.Context, addr string) (*Client, error) {
+	var d Dialer
+	return d.DialContext(ctx, addr)
+}
+
+// DialTLSContext is like DialTLS, but uses ctx for dialing, for the TLS
+// handshake and for reading the server greeting.
+func DialTLSContext(ctx context.Context, addr string, tlsConfig *tls.Config) (*Client, error) {
+	var d Dialer
+	return d.DialTLSContext(ctx, addr, tlsConfig)
+}
+
 // NewClient returns a new Client using an existing connection and host as a
 // server name to be used when authenticating.
 func NewClient(conn net.Conn, host string) (*Client, error) {
-	c := &Client{
+	c := newClient(host)
+	return c, c.InitConn(conn)
+}
+
+// NewClientContext is like NewClient, but uses ctx for reading the server
+// greeting.
+func NewClientContext(ctx context.Context, conn net.Conn, host string) (*Client, error) {
+	c := newClient(host)
+	w := c.watchContext(ctx, conn)
+	return c, w.stop(c.InitConn(conn))
+}
+
+func newClient(host string) *Client {
+	return &Client{
 		serverName: host,
 		localName:  "localhost",
 		// As recommended by RFC 5321. For DATA command reply (3xx one) RFC
@@ -104,8 +313,6 @@ func NewClient(conn net.Conn, host string) (*Client, error) {
 		// forwarding and also follows recommended timeouts.
 		SubmissionTimeout: 12 * time.Minute,
 	}
-
-	return c, c.InitConn(conn)
 }
 
 // NewClientLMTP returns a new LMTP Client (as defined in RFC 2033) using an
@@ -235,10 +442,8 @@ func (c *Client) InitConn(conn net.Conn) error {
 	c.setConn(conn)
 
 	// Set initial greeting timeout.
-	if t := c.CommandTimeout; t > 0 {
-		c.conn.SetDeadline(time.Now().Add(t))
-		defer c.conn.SetDeadline(time.Time{})
-	}
+	c.setTimeout(c.CommandTimeout)
+	defer c.resetTimeout()
 
 	_, _, err := c.Text.ReadResponse(220)
 	if err != nil {
@@ -252,6 +457,116 @@ func (c *Client) InitConn(conn net.Conn) error {
 	return nil
 }
 
+// setTimeout sets the connection deadline to t from now, or to the deadline
+// of the context of the current operation if it's earlier. A zero t means no
+// timeout.
+func (c *Client) setTimeout(t time.Duration) {
+	var d time.Time
+	if t > 0 {
+		d = time.Now().Add(t)
+	}
+
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.conn.SetDeadline(c.deadline(d))
+}
+
+// resetTimeout resets the connection deadline after setTimeout.
+func (c *Client) resetTimeout() {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.conn.SetDeadline(c.deadline(time.Time{}))
+}
+
+// deadline returns the earliest of d and of the context deadline. The caller
+// must hold deadlineMu.
+func (c *Client) deadline(d time.Time) time.Time {
+	if c.ctxDone {
+		return aLongTimeAgo
+	}
+	if !c.ctxDeadline.IsZero() && (d.IsZero() || c.ctxDeadline.Before(d)) {
+		return c.ctxDeadline
+	}
+	return d
+}
+
+// contextWatcher ties the connection deadline to a context.
+type contextWatcher struct {
+	c        *Client
+	ctx      context.Context
+	deadline time.Time
+	stopCh   chan struct{}
+	done     chan struct{}
+}
+
+// watchContext ties the deadline of conn to ctx until stop is called on the
+// returned watcher. If ctx is done before, pending I/O is interrupted and
+// the Client can't be used anymore.
+func (c *Client) watchContext(ctx context.Context, conn net.Conn) *contextWatcher {
+	w := &contextWatcher{
+		c:      c,
+		ctx:    ctx,
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	w.deadline, _ = ctx.Deadline()
+
+	c.deadlineMu.Lock()
+	c.ctxDeadline = w.deadline
+	conn.SetDeadline(c.deadline(time.Time{}))
+	c.deadlineMu.Unlock()
+
+	go func() {
+		defer close(w.done)
+		select {
+		case <-ctx.Done():
+			c.deadlineMu.Lock()
+			c.ctxDone = true
+			conn.SetDeadline(aLongTimeAgo)
+			c.deadlineMu.Unlock()
+		case <-w.stopCh:
+		}
+	}()
+
+	return w
+}
+
+// err converts an error caused by the context into the context error.
+func (w *contextWatcher) err(err error) error {
+	if err == nil {
+		return nil
+	}
+	ctxErr := w.ctx.Err()
+	if ctxErr == nil && !w.deadline.IsZero() && !time.Now().Before(w.deadline) {
+		ctxErr = context.DeadlineExceeded
+	}
+	if ctxErr != nil {
+		return fmt.Errorf("smtp: %w", ctxErr)
+	}
+	return err
+}
+
+// stop stops watching the context. err is the result of the operation.
+func (w *contextWatcher) stop(err error) error {
+	close(w.stopCh)
+	<-w.done
+
+	w.c.deadlineMu.Lock()
+	w.c.ctxDeadline = time.Time{}
+	if !w.c.ctxDone && w.c.conn != nil {
+		w.c.conn.SetDeadline(time.Time{})
+	}
+	w.c.deadlineMu.Unlock()
+
+	return w.err(err)
+}
+
+// withContext runs f with the connection deadline tied to ctx.
+func (c *Client) withContext(ctx context.Context, f func() error) error {
+	w := c.watchContext(ctx, c.conn.Conn)
+	return w.stop(f())
+}
+
 // Close closes the connection.
 func (c *Client) Close() error {
 	return c.Text.Close()
@@ -265,6 +580,9 @@ func (c *Client) hello() error {
 		if err != nil {
 			c.helloError = c.helo()
 		}
+		if c.helloError == nil {
+			c.helloError = c.startTLSPolicy()
+		}
 	}
 	return c.helloError
 }
@@ -287,13 +605,18 @@ func (c *Client) Hello(localName string) error {
 	return c.hello()
 }
 
+// HelloContext is like Hello, but uses ctx for the greeting exchange.
+func (c *Client) HelloContext(ctx context.Context, localName string) error {
+	return c.withContext(ctx, func() error {
+		return c.Hello(localName)
+	})
+}
+
 // cmd is a convenience function that sends a command and returns the response
 // textproto.Error returned by c.Text.ReadResponse is converted into SMTPError.
 func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
-	if t := c.CommandTimeout; t > 0 {
-		c.conn.SetDeadline(time.Now().Add(t))
-		defer c.conn.SetDeadline(time.Time{})
-	}
+	c.setTimeout(c.CommandTimeout)
+	defer c.resetTimeout()
 
 	id, err := c.Text.Cmd(format, args...)
 	if err != nil {
@@ -369,42 +692,193 @@ func (c *Client) StartTLS(config *tls.Config) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
+	if c.tls {
+		return errors.New("smtp: TLS already started")
+	}
+	return c.startTLS(config, false)
+}
+
+// startTLS sends the STARTTLS command and performs the TLS handshake. If
+// opportunistic is true, invalid certificates are accepted but reported as
+// unverified.
+func (c *Client) startTLS(config *tls.Config, opportunistic bool) error {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	// Make a copy to avoid polluting argument
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = c.serverName
+	}
+
+	records, required, err := c.lookupTLSA(config.ServerName)
+	if err != nil {
+		return err
+	}
 
 	// stop connection monitoring
 	c.conn.cancel()
 
-	_, _, err := c.cmd(220, "STARTTLS")
+	_, _, err = c.cmd(220, "STARTTLS")
 	if err != nil {
 		c.setConn(c.conn.Conn)
 		return err
 	}
-	if config == nil {
-		config = &tls.Config{}
-	}
-	if config.ServerName == "" {
-		// Make a copy to avoid polluting argument
-		config = config.Clone()
-		config.ServerName = c.serverName
-	}
 	if testHookStartTLS != nil {
 		testHookStartTLS(config)
 	}
 
-	conn := tls.Client(c.conn.Conn, config)
-	if c.CommandTimeout > 0 {
-		conn.SetDeadline(time.Now().Add(c.CommandTimeout))
-		defer conn.SetDeadline(time.Time{})
+	c.tlsVerified = false
+	c.tlsVerifyErr = nil
+	c.tlsaMatch = nil
+	if len(records) > 0 {
+		setDANEVerification(config, records, func(r *TLSA) {
+			c.tlsaMatch = r
+			c.tlsVerified = true
+		})
+	} else if opportunistic && !config.InsecureSkipVerify {
+		config.InsecureSkipVerify = true
+		// Resumed sessions skip VerifyPeerCertificate
+		config.ClientSessionCache = nil
+		verifyPeerCertificate := config.VerifyPeerCertificate
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			certs, err := parseCertificates(rawCerts)
+			if err != nil {
+				return err
+			}
+			var chains [][]*x509.Certificate
+			chains, c.tlsVerifyErr = verifyCertificates(certs, config)
+			c.tlsVerified = c.tlsVerifyErr == nil
+			if verifyPeerCertificate != nil {
+				return verifyPeerCertificate(rawCerts, chains)
+			}
+			return nil
+		}
 	}
 
+	conn := tls.Client(c.conn.Conn, config)
+	c.setTimeout(c.CommandTimeout)
+	defer c.resetTimeout()
+
 	if err := conn.Handshake(); err != nil {
 		c.Close()
-		return err
+		return daneHandshakeError(err, config.ServerName, required)
 	}
 
 	c.setConn(conn)
 	return c.ehlo()
 }
 
+// startTLSPolicy starts TLS as requested by TLSPolicy.
+func (c *Client) startTLSPolicy() error {
+	if c.TLSPolicy == TLSPolicyNone || c.tls {
+		return nil
+	}
+
+	serverName := c.serverName
+	if c.TLSConfig != nil && c.TLSConfig.ServerName != "" {
+		serverName = c.TLSConfig.ServerName
+	}
+	_, required, err := c.lookupTLSA(serverName)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := c.ext["STARTTLS"]; !ok {
+		if required {
+			return &DANEError{
+				ServerName: serverName,
+				Err:        errors.New("server doesn't support STARTTLS"),
+			}
+		}
+		if c.TLSPolicy == TLSPolicyRequired {
+			return errors.New("smtp: server doesn't support STARTTLS")
+		}
+		return nil
+	}
+
+	opportunistic := c.TLSPolicy == TLSPolicyOpportunistic
+	err = c.startTLS(c.TLSConfig, opportunistic)
+	if _, ok := err.(*SMTPError); ok && opportunistic && !c.tls && !required {
+		// STARTTLS was rejected, carry on in cleartext
+		return nil
+	}
+	return err
+}
+
+// lookupTLSA returns the usable TLSA records of the server if DANE is
+// enabled, and reports whether DANE requires TLS.
+func (c *Client) lookupTLSA(serverName string) ([]TLSA, bool, error) {
+	if c.DANE == nil || c.tlsaLookedUp {
+		return c.tlsaRecords, c.tlsaRequired, nil
+	}
+
+	c.deadlineMu.Lock()
+	var timeout time.Time
+	if c.CommandTimeout != 0 {
+		timeout = time.Now().Add(c.CommandTimeout)
+	}
+	deadline := c.deadline(timeout)
+	c.deadlineMu.Unlock()
+
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	records, required, err := c.DANE.lookup(ctx, serverName)
+	if err != nil {
+		return nil, false, err
+	}
+	c.tlsaLookedUp = true
+	c.tlsaRecords = records
+	c.tlsaRequired = required
+	return records, required, nil
+}
+
+// parseCertificates parses the certificate chain sent by the server.
+func parseCertificates(rawCerts [][]byte) ([]*x509.Certificate, error) {
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		certs[i] = cert
+	}
+	return certs, nil
+}
+
+// verifyCertificates verifies the certificate chain sent by the server like
+// crypto/tls does, and returns the verified chains.
+func verifyCertificates(certs []*x509.Certificate, config *tls.Config) ([][]*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("smtp: server didn't send any certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         config.RootCAs,
+		DNSName:       config.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	if config.Time != nil {
+		opts.CurrentTime = config.Time()
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	return certs[0].Verify(opts)
+}
+
+// StartTLSContext is like StartTLS, but uses ctx for the STARTTLS command
+// and the TLS handshake.
+func (c *Client) StartTLSContext(ctx context.Context, config *tls.Config) error {
+	return c.withContext(ctx, func() error {
+		return c.StartTLS(config)
+	})
+}
+
 // TLSConnectionState returns the client's TLS connection state.
 // The return values are their zero values if StartTLS did
 // not succeed.
@@ -416,6 +890,62 @@ func (c *Client) TLSConnectionState() (state tls.ConnectionState, ok bool) {
 	return tc.ConnectionState(), true
 }
 
+// TLSReport describes the TLS connection of a Client.
+type TLSReport struct {
+	// Whether the connection is encrypted with TLS. If false, the other
+	// fields are their zero values.
+	Encrypted bool
+	// TLS version and cipher suite, as defined in crypto/tls.
+	Version     uint16
+	CipherSuite uint16
+	// Server name used to verify the certificate.
+	ServerName string
+	// Whether the certificate chain sent by the server has been verified.
+	Verified bool
+	// The reason the certificate chain couldn't be verified, if known.
+	VerifyError error
+	// The TLSA record which matched the certificate chain, if the server
+	// has been authenticated with DANE.
+	TLSA *TLSA
+}
+
+// String returns a human-readable description of the TLS connection,
+// suitable for logs.
+func (r *TLSReport) String() string {
+	if !r.Encrypted {
+		return "no TLS"
+	}
+	s := fmt.Sprintf("%v with cipher %v", tls.VersionName(r.Version), tls.CipherSuiteName(r.CipherSuite))
+	if r.TLSA != nil {
+		s += fmt.Sprintf(", verified with DANE (TLSA %v)", r.TLSA)
+	} else if r.Verified {
+		s += ", verified"
+	} else if r.VerifyError != nil {
+		s += fmt.Sprintf(", not verified (%v)", r.VerifyError)
+	} else {
+		s += ", not verified"
+	}
+	return s
+}
+
+// TLSReport returns a description of the TLS parameters negotiated with the
+// server.
+func (c *Client) TLSReport() TLSReport {
+	cs, ok := c.TLSConnectionState()
+	if !ok {
+		return TLSReport{}
+	}
+	return TLSReport{
+		Encrypted:   true,
+		Version:     cs.Version,
+		CipherSuite: cs.CipherSuite,
+		ServerName:  cs.ServerName,
+		Verified:    c.tlsVerified || len(cs.VerifiedChains) > 0,
+		VerifyError: c.tlsVerifyErr,
+		TLSA:        c.tlsaMatch,
+	}
+}
+
 // Verify checks the validity of an email address on the server.
 // If Verify returns nil, the address is valid. A non-nil return
 // does not necessarily indicate an invalid address. Many servers
@@ -423,14 +953,44 @@ func (c *Client) TLSConnectionState() (state tls.ConnectionState, ok bool) {
 //
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Verify(addr string) error {
+	_, err := c.VerifyMailboxes(addr)
+	return err
+}
+
+// VerifyMailboxes is like Verify, but also returns the mailboxes matching
+// addr, as returned by the server, e.g. "Jane Doe <jane@example.org>".
+//
+// If server returns an error, it will be of type *SMTPError.
+func (c *Client) VerifyMailboxes(addr string) ([]string, error) {
 	if err := validateLine(addr); err != nil {
-		return err
+		return nil, err
 	}
 	if err := c.hello(); err != nil {
-		return err
+		return nil, err
 	}
-	_, _, err := c.cmd(250, "VRFY %s", addr)
-	return err
+	_, msg, err := c.cmd(250, "VRFY %s", addr)
+	if err != nil {
+		return nil, err
+	}
+	return parseMailboxes(msg), nil
+}
+
+// Expand asks the server for the members of a mailing list. Many servers
+// will not expand mailing lists for security reasons.
+//
+// If server returns an error, it will be of type *SMTPError.
+func (c *Client) Expand(list string) ([]string, error) {
+	if err := validateLine(list); err != nil {
+		return nil, err
+	}
+	if err := c.hello(); err != nil {
+		return nil, err
+	}
+	_, msg, err := c.cmd(250, "EXPN %s", list)
+	if err != nil {
+		return nil, err
+	}
+	return parseMailboxes(msg), nil
 }
 
 // Auth authenticates a client using the provided authentication mechanism.
@@ -448,6 +1008,10 @@ func (c *Client) Auth(a sasl.Client) error {
 	}
 	resp64 := make([]byte, encoding.EncodedLen(len(resp)))
 	encoding.Encode(resp64, resp)
+	if resp != nil && len(resp) == 0 {
+		// Empty initial response (RFC 4954 section 4)
+		resp64 = []byte("=")
+	}
 	code, msg64, err := c.cmd(0, strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, resp64)))
 	for err == nil {
 		var msg []byte
@@ -482,9 +1046,17 @@ func (c *Client) Auth(a sasl.Client) error {
 	return err
 }
 
+// AuthContext is like Auth, but uses ctx for the authentication exchange.
+func (c *Client) AuthContext(ctx context.Context, a sasl.Client) error {
+	return c.withContext(ctx, func() error {
+		return c.Auth(a)
+	})
+}
+
 // Mail issues a MAIL command to the server using the provided email address.
 // If the server supports the 8BITMIME extension, Mail adds the BODY=8BITMIME
-// parameter.
+// parameter, unless another body type is requested in opts. BINARYMIME
+// requires the server to support the BINARYMIME and CHUNKING extensions.
 // This initiates a mail transaction and is followed by one or more Rcpt calls.
 //
 // If opts is not nil, MAIL arguments provided in the structure will be added
@@ -492,31 +1064,65 @@ func (c *Client) Auth(a sasl.Client) error {
 //
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Mail(from string, opts *MailOptions) error {
-	if err := validateLine(from); err != nil {
+	if err := c.hello(); err != nil {
 		return err
 	}
-	if err := c.hello(); err != nil {
+	cmdStr, err := c.mailCmd(from, opts)
+	if err != nil {
 		return err
 	}
-	cmdStr := "MAIL FROM:<%s>"
-	if _, ok := c.ext["8BITMIME"]; ok {
-		cmdStr += " BODY=8BITMIME"
+	if _, _, err := c.cmd(250, "%s", cmdStr); err != nil {
+		return err
+	}
+	c.binaryMIME = opts != nil && opts.Body == BodyBinaryMIME
+	return nil
+}
+
+// MailContext is like Mail, but uses ctx for the MAIL command.
+func (c *Client) MailContext(ctx context.Context, from string, opts *MailOptions) error {
+	return c.withContext(ctx, func() error {
+		return c.Mail(from, opts)
+	})
+}
+
+// mailCmd formats a MAIL command.
+func (c *Client) mailCmd(from string, opts *MailOptions) (string, error) {
+	if err := validateLine(from); err != nil {
+		return "", err
+	}
+	cmdStr := "MAIL FROM:<" + from + ">"
+	if opts != nil && opts.Body == BodyBinaryMIME {
+		_, binarymime := c.ext["BINARYMIME"]
+		_, chunking := c.ext["CHUNKING"]
+		if !binarymime || !chunking {
+			return "", errors.New("smtp: server does not support BINARYMIME")
+		}
+		cmdStr += " BODY=BINARYMIME"
+	} else if _, ok := c.ext["8BITMIME"]; ok {
+		if opts != nil && opts.Body == Body7Bit {
+			cmdStr += " BODY=7BIT"
+		} else {
+			cmdStr += " BODY=8BITMIME"
+		}
 	}
 	if _, ok := c.ext["SIZE"]; ok && opts != nil && opts.Size != 0 {
 		cmdStr += " SIZE=" + strconv.Itoa(opts.Size)
 	}
 	if opts != nil && opts.RequireTLS {
+		if report := c.TLSReport(); !report.Verified {
+			return "", errors.New("smtp: REQUIRETLS needs a verified TLS connection")
+		}
 		if _, ok := c.ext["REQUIRETLS"]; ok {
 			cmdStr += " REQUIRETLS"
 		} else {
-			return errors.New("smtp: server does not support REQUIRETLS")
+			return "", errors.New("smtp: server does not support REQUIRETLS")
 		}
 	}
 	if opts != nil && opts.UTF8 {
 		if _, ok := c.ext["SMTPUTF8"]; ok {
 			cmdStr += " SMTPUTF8"
 		} else {
-			return errors.New("smtp: server does not support SMTPUTF8")
+			return "", errors.New("smtp: server does not support SMTPUTF8")
 		}
 	}
 	if opts != nil && opts.Auth != nil {
@@ -525,8 +1131,18 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 		}
 		// We can safely discard parameter if server does not support AUTH.
 	}
-	_, _, err := c.cmd(250, cmdStr, from)
-	return err
+	if opts != nil && (opts.Return != "" || opts.EnvelopeID != "") {
+		if _, ok := c.ext["DSN"]; !ok {
+			return "", errors.New("smtp: server does not support DSN")
+		}
+		if opts.Return != "" {
+			cmdStr += " RET=" + string(opts.Return)
+		}
+		if opts.EnvelopeID != "" {
+			cmdStr += " ENVID=" + encodeXtext(opts.EnvelopeID)
+		}
+	}
+	return cmdStr, nil
 }
 
 // Rcpt issues a RCPT command to the server using the provided email address.
@@ -535,16 +1151,60 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 //
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Rcpt(to string) error {
-	if err := validateLine(to); err != nil {
+	return c.RcptWithOptions(to, nil)
+}
+
+// RcptWithOptions is like Rcpt, but adds the RCPT arguments provided in opts
+// to the command.
+//
+// If server returns an error, it will be of type *SMTPError.
+func (c *Client) RcptWithOptions(to string, opts *RcptOptions) error {
+	cmdStr, err := c.rcptCmd(to, opts)
+	if err != nil {
 		return err
 	}
-	if _, _, err := c.cmd(25, "RCPT TO:<%s>", to); err != nil {
+	if _, _, err := c.cmd(25, "%s", cmdStr); err != nil {
 		return err
 	}
 	c.rcpts = append(c.rcpts, to)
 	return nil
 }
 
+// RcptContext is like RcptWithOptions, but uses ctx for the RCPT command.
+func (c *Client) RcptContext(ctx context.Context, to string, opts *RcptOptions) error {
+	return c.withContext(ctx, func() error {
+		return c.RcptWithOptions(to, opts)
+	})
+}
+
+// rcptCmd formats a RCPT command.
+func (c *Client) rcptCmd(to string, opts *RcptOptions) (string, error) {
+	if err := validateLine(to); err != nil {
+		return "", err
+	}
+	cmdStr := "RCPT TO:<" + to + ">"
+	if opts != nil && (len(opts.Notify) > 0 || opts.OriginalRecipient != "") {
+		if _, ok := c.ext["DSN"]; !ok {
+			return "", errors.New("smtp: server does not support DSN")
+		}
+		if len(opts.Notify) > 0 {
+			notify := make([]string, len(opts.Notify))
+			for i, n := range opts.Notify {
+				notify[i] = string(n)
+			}
+			cmdStr += " NOTIFY=" + strings.Join(notify, ",")
+		}
+		if opts.OriginalRecipient != "" {
+			typ := opts.OriginalRecipientType
+			if typ == "" {
+				typ = DSNAddressTypeRFC822
+			}
+			cmdStr += " ORCPT=" + string(typ) + ";" + encodeXtext(opts.OriginalRecipient)
+		}
+	}
+	return cmdStr, nil
+}
+
 type dataCloser struct {
 	c *Client
 	io.WriteCloser
@@ -553,13 +1213,19 @@ type dataCloser struct {
 }
 
 func (d *dataCloser) Close() error {
-	d.WriteCloser.Close()
+	// The mail transaction is over
+	defer func() {
+		d.c.rcpts = nil
+		d.c.inData = false
+	}()
 
-	if t := d.c.SubmissionTimeout; t > 0 {
-		d.c.conn.SetDeadline(time.Now().Add(t))
-		defer d.c.conn.SetDeadline(time.Time{})
+	if err := d.WriteCloser.Close(); err != nil {
+		return err
 	}
 
+	d.c.setTimeout(d.c.SubmissionTimeout)
+	defer d.c.resetTimeout()
+
 	if !d.c.lmtp {
 		code, msg, err := d.c.Text.ReadResponse(250)
 		if err != nil {
@@ -611,21 +1277,175 @@ func (d *dataCloser) Close() error {
 	return nil
 }
 
+// bdatWriter sends the data written to it in BDAT chunks. The reply to the
+// last chunk is read by dataCloser.
+type bdatWriter struct {
+	c   *Client
+	buf []byte
+	err error
+}
+
+func (w *bdatWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n := len(b)
+	size := cap(w.buf)
+	for len(w.buf)+len(b) >= size {
+		i := size - len(w.buf)
+		w.buf = append(w.buf, b[:i]...)
+		b = b[i:]
+		if w.err = w.sendChunk(false); w.err != nil {
+			return 0, w.err
+		}
+	}
+	w.buf = append(w.buf, b...)
+	return n, nil
+}
+
+func (w *bdatWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.sendChunk(true)
+	if w.err == nil {
+		w.err = errors.New("smtp: write to closed BDAT writer")
+		return nil
+	}
+	return w.err
+}
+
+func (w *bdatWriter) sendChunk(last bool) error {
+	w.c.setTimeout(w.c.CommandTimeout)
+	defer w.c.resetTimeout()
+
+	cmd := fmt.Sprintf("BDAT %v", len(w.buf))
+	if last {
+		cmd += " LAST"
+	}
+	if err := w.c.Text.PrintfLine("%s", cmd); err != nil {
+		return err
+	}
+	if _, err := w.c.Text.W.Write(w.buf); err != nil {
+		return err
+	}
+	if err := w.c.Text.W.Flush(); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+
+	if last {
+		return nil
+	}
+	_, _, err := w.c.readResponse(250)
+	return err
+}
+
+// newBDATWriter returns a writer sending the message data with BDAT. Unless
+// the message is sent with BODY=BINARYMIME, line endings are normalized like
+// DATA does.
+func (c *Client) newBDATWriter() io.WriteCloser {
+	size := c.ChunkSize
+	if size <= 0 {
+		size = defaultChunkSize
+	}
+	w := &bdatWriter{c: c, buf: make([]byte, 0, size)}
+	if c.binaryMIME {
+		return w
+	}
+	return &crlfWriter{w: w}
+}
+
+// crlfWriter converts bare LF line endings to CRLF, like the writer returned
+// by textproto.Writer.DotWriter. The data is terminated with CRLF if needed.
+type crlfWriter struct {
+	w    io.WriteCloser
+	last byte // last byte written
+}
+
+func (w *crlfWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			if _, err := w.w.Write(b); err != nil {
+				return n, err
+			}
+			w.last = b[len(b)-1]
+			return n + len(b), nil
+		}
+
+		prev := w.last
+		if i > 0 {
+			prev = b[i-1]
+		}
+		line := b[:i+1]
+		if prev != '\r' {
+			line = append(b[:i:i], '\r', '\n')
+		}
+		if _, err := w.w.Write(line); err != nil {
+			return n, err
+		}
+		n += i + 1
+		w.last = '\n'
+		b = b[i+1:]
+	}
+	return n, nil
+}
+
+func (w *crlfWriter) Close() error {
+	if w.last != 0 && w.last != '\n' {
+		if _, err := w.w.Write([]byte("\r\n")); err != nil {
+			return err
+		}
+	}
+	return w.w.Close()
+}
+
+// dataWriter returns the writer used to send the message data: a BDAT
+// writer if the server supports the CHUNKING extension, otherwise a dot
+// writer after issuing a DATA command.
+func (c *Client) dataWriter() (io.WriteCloser, error) {
+	if _, ok := c.ext["CHUNKING"]; ok {
+		return c.newBDATWriter(), nil
+	}
+
+	_, _, err := c.cmd(354, "DATA")
+	if err != nil {
+		return nil, err
+	}
+	return c.dotWriter(), nil
+}
+
+// dotWriter returns a writer sending the message data after a DATA command.
+// Until the writer is closed, the connection can't be used for other
+// commands.
+func (c *Client) dotWriter() io.WriteCloser {
+	c.inData = true
+	return c.Text.DotWriter()
+}
+
 // Data issues a DATA command to the server and returns a writer that can be
 // used to write the mail headers and body. It accepts a callback that will be
 // called for a positive server reply. The caller should close the writer before
 // calling any more methods on c. A call to Data must be preceded by one or more
 // calls to Rcpt.
 //
+// If the server supports the CHUNKING extension, the message is sent with
+// BDAT commands instead, in chunks of ChunkSize bytes. As with DATA, bare LF
+// line endings are converted to CRLF, unless the message is sent with
+// BODY=BINARYMIME.
+//
 // Status callback will receive an SMTPError argument for a positive server
 // reply. I/O errors or negative server replies will not be reported using
 // callback and instead will be returned by the Close method of io.WriteCloser.
 func (c *Client) Data(statusCb func(status *SMTPError)) (io.WriteCloser, error) {
-	_, _, err := c.cmd(354, "DATA")
+	w, err := c.dataWriter()
 	if err != nil {
 		return nil, err
 	}
-	return &dataCloser{c, c.Text.DotWriter(), statusCb, nil}, nil
+	return &dataCloser{c, w, statusCb, nil}, nil
 }
 
 // LMTPData is the LMTP-specific version of the Data method. It accepts a
@@ -640,11 +1460,281 @@ func (c *Client) LMTPData(lmtpStatusCb func(rcpt string, status *SMTPError)) (io
 	if !c.lmtp {
 		return nil, errors.New("smtp: not a LMTP client")
 	}
-	_, _, err := c.cmd(354, "DATA")
+	w, err := c.dataWriter()
 	if err != nil {
 		return nil, err
 	}
-	return &dataCloser{c, c.Text.DotWriter(), nil, lmtpStatusCb}, nil
+	return &dataCloser{c, w, nil, lmtpStatusCb}, nil
+}
+
+// contextWriteCloser ties the connection deadline to a context until it's
+// closed.
+type contextWriteCloser struct {
+	io.WriteCloser
+	w *contextWatcher
+}
+
+func (cw *contextWriteCloser) Write(b []byte) (int, error) {
+	n, err := cw.WriteCloser.Write(b)
+	return n, cw.w.err(err)
+}
+
+func (cw *contextWriteCloser) Close() error {
+	return cw.w.stop(cw.WriteCloser.Close())
+}
+
+// DataContext is like Data, but uses ctx until the returned writer is
+// closed.
+func (c *Client) DataContext(ctx context.Context, statusCb func(status *SMTPError)) (io.WriteCloser, error) {
+	w := c.watchContext(ctx, c.conn.Conn)
+	wc, err := c.Data(statusCb)
+	if err != nil {
+		return nil, w.stop(err)
+	}
+	return &contextWriteCloser{wc, w}, nil
+}
+
+// Recipient is a recipient of a mail transaction sent with SendTransaction.
+type Recipient struct {
+	Addr string
+	Opts *RcptOptions
+}
+
+// RecipientResult is the outcome of a mail transaction for a recipient.
+type RecipientResult struct {
+	Addr string
+	// The reply to the RCPT command if the recipient was rejected, nil
+	// otherwise.
+	Err *SMTPError
+	// For LMTP clients, the reply for this recipient after the message data,
+	// positive or negative. nil if the recipient was rejected or if the
+	// message data wasn't sent.
+	Status *SMTPError
+}
+
+// Delivered reports whether the message was accepted for this recipient.
+// For SMTP clients, the reply to the message data must be checked too.
+func (r *RecipientResult) Delivered() bool {
+	return r.Err == nil && (r.Status == nil || r.Status.Code/100 == 2)
+}
+
+// TransactionResult is the outcome of a mail transaction sent with
+// SendTransaction.
+type TransactionResult struct {
+	// Results for each recipient, in the same order as the recipients passed
+	// to SendTransaction.
+	Recipients []RecipientResult
+	// For SMTP clients, the reply after the message data, positive or
+	// negative. nil if the message data wasn't sent or for LMTP clients.
+	Data *SMTPError
+}
+
+// ErrNoValidRecipients is returned by SendTransaction if all recipients have
+// been rejected.
+var ErrNoValidRecipients = errors.New("smtp: no valid recipients")
+
+// SendTransaction runs a mail transaction on an existing connection: it
+// issues a MAIL command, a RCPT command for each recipient and sends the
+// message read from r.
+//
+// If the server supports the PIPELINING extension (RFC 2920), the MAIL, RCPT
+// and DATA commands are sent in a single batch. Otherwise, they are sent one
+// at a time.
+//
+// Rejected recipients don't abort the transaction: the message is sent to
+// the accepted ones. The returned result reports which recipients were
+// rejected and the replies received after the message data, including the
+// per-recipient replies of LMTP servers. It is nil only if the transaction
+// failed before the RCPT commands. If all recipients are rejected, the
+// message isn't sent and ErrNoValidRecipients is returned along with the
+// result. If the transaction is aborted by a negative reply, it is reset
+// with RSET so that the connection can be reused.
+//
+// For LMTP clients, negative replies after the message data are only
+// reported in the result.
+//
+// If server returns an error, it will be of type *SMTPError.
+func (c *Client) SendTransaction(from string, opts *MailOptions, rcpts []Recipient, r io.Reader) (*TransactionResult, error) {
+	if err := c.hello(); err != nil {
+		return nil, err
+	}
+
+	var (
+		result *TransactionResult
+		w      io.WriteCloser
+		err    error
+	)
+	if _, ok := c.ext["PIPELINING"]; ok {
+		result, w, err = c.pipelineTransaction(from, opts, rcpts)
+	} else {
+		result, w, err = c.lockstepTransaction(from, opts, rcpts)
+	}
+	if err != nil {
+		return result, c.abortTransaction(err)
+	}
+
+	// Replies to the message data are reported in order for accepted
+	// recipients
+	var accepted []*RecipientResult
+	for i := range result.Recipients {
+		if result.Recipients[i].Err == nil {
+			accepted = append(accepted, &result.Recipients[i])
+		}
+	}
+	dc := &dataCloser{
+		c:           c,
+		WriteCloser: w,
+		statusCb: func(status *SMTPError) {
+			result.Data = status
+		},
+		lmtpStatusCb: func(rcpt string, status *SMTPError) {
+			if len(accepted) == 0 {
+				return
+			}
+			accepted[0].Status = status
+			accepted = accepted[1:]
+		},
+	}
+
+	if _, err := io.Copy(dc, r); err != nil {
+		// A BDAT chunk may have been rejected
+		return result, c.abortTransaction(err)
+	}
+	err = dc.Close()
+	if smtpErr, ok := err.(*SMTPError); ok && !c.lmtp {
+		result.Data = smtpErr
+	}
+	return result, err
+}
+
+// abortTransaction resets the mail transaction after err, unless err
+// happened before the transaction started or the connection is unusable. It
+// returns err.
+func (c *Client) abortTransaction(err error) error {
+	if _, ok := err.(*SMTPError); ok || err == ErrNoValidRecipients {
+		c.Reset()
+	}
+	return err
+}
+
+func (c *Client) lockstepTransaction(from string, opts *MailOptions, rcpts []Recipient) (*TransactionResult, io.WriteCloser, error) {
+	// Check the recipients before starting the transaction
+	for _, rcpt := range rcpts {
+		if _, err := c.rcptCmd(rcpt.Addr, rcpt.Opts); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := c.Mail(from, opts); err != nil {
+		return nil, nil, err
+	}
+
+	result := &TransactionResult{Recipients: make([]RecipientResult, len(rcpts))}
+	accepted := 0
+	for i, rcpt := range rcpts {
+		result.Recipients[i].Addr = rcpt.Addr
+		err := c.RcptWithOptions(rcpt.Addr, rcpt.Opts)
+		if smtpErr, ok := err.(*SMTPError); ok {
+			result.Recipients[i].Err = smtpErr
+			continue
+		} else if err != nil {
+			return result, nil, err
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return result, nil, ErrNoValidRecipients
+	}
+
+	w, err := c.dataWriter()
+	return result, w, err
+}
+
+func (c *Client) pipelineTransaction(from string, opts *MailOptions, rcpts []Recipient) (*TransactionResult, io.WriteCloser, error) {
+	mailCmd, err := c.mailCmd(from, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmds := []string{mailCmd}
+	for _, rcpt := range rcpts {
+		rcptCmd, err := c.rcptCmd(rcpt.Addr, rcpt.Opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		cmds = append(cmds, rcptCmd)
+	}
+	// With CHUNKING, BDAT is only sent once some recipients are accepted
+	_, chunking := c.ext["CHUNKING"]
+	if !chunking {
+		cmds = append(cmds, "DATA")
+	}
+
+	c.setTimeout(c.CommandTimeout)
+	defer c.resetTimeout()
+
+	for _, cmd := range cmds {
+		if _, err := c.Text.W.WriteString(cmd + "\r\n"); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := c.Text.W.Flush(); err != nil {
+		return nil, nil, err
+	}
+
+	// All replies need to be read, even if MAIL is rejected
+	_, _, mailErr := c.readResponse(250)
+	if _, ok := mailErr.(*SMTPError); mailErr != nil && !ok {
+		return nil, nil, mailErr
+	}
+
+	result := &TransactionResult{Recipients: make([]RecipientResult, len(rcpts))}
+	accepted := 0
+	for i, rcpt := range rcpts {
+		result.Recipients[i].Addr = rcpt.Addr
+		_, _, err := c.readResponse(25)
+		if smtpErr, ok := err.(*SMTPError); ok {
+			result.Recipients[i].Err = smtpErr
+			continue
+		} else if err != nil {
+			return result, nil, err
+		}
+		c.rcpts = append(c.rcpts, rcpt.Addr)
+		accepted++
+	}
+
+	var dataErr error
+	if !chunking {
+		_, _, dataErr = c.readResponse(354)
+		if _, ok := dataErr.(*SMTPError); dataErr != nil && !ok {
+			return result, nil, dataErr
+		}
+	}
+
+	if mailErr != nil {
+		c.rcpts = nil
+		return nil, nil, mailErr
+	}
+	c.binaryMIME = opts != nil && opts.Body == BodyBinaryMIME
+
+	if accepted == 0 {
+		if !chunking && dataErr == nil {
+			// The server accepted DATA anyway: send an empty message, which
+			// will be rejected (RFC 2920 section 3.1)
+			if err := c.Text.PrintfLine("."); err != nil {
+				return result, nil, err
+			}
+			c.readResponse(250)
+		}
+		return result, nil, ErrNoValidRecipients
+	}
+	if dataErr != nil {
+		return result, nil, dataErr
+	}
+
+	if chunking {
+		return result, c.newBDATWriter(), nil
+	}
+	return result, c.dotWriter(), nil
 }
 
 // SendMail will use an existing connection to send an email from
@@ -662,6 +1752,14 @@ func (c *Client) LMTPData(lmtpStatusCb func(rcpt string, status *SMTPError)) (io
 // messages is accomplished by including an email address in the to
 // parameter but not including it in the r headers.
 func (c *Client) SendMail(from string, to []string, r io.Reader) error {
+	if err := c.sendMail(from, to, r); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// sendMail is SendMail without QUIT.
+func (c *Client) sendMail(from string, to []string, r io.Reader) error {
 	var err error
 
 	if err = c.Mail(from, nil); err != nil {
@@ -680,11 +1778,31 @@ func (c *Client) SendMail(from string, to []string, r io.Reader) error {
 	if err != nil {
 		return err
 	}
-	err = w.Close()
+	return w.Close()
+}
+
+// SendMailContext is like SendMail, but uses ctx for the whole mail
+// transaction.
+func (c *Client) SendMailContext(ctx context.Context, from string, to []string, r io.Reader) error {
+	return c.withContext(ctx, func() error {
+		return c.SendMail(from, to, r)
+	})
+}
+
+// SendMailWithResult is like SendMail, but doesn't abort if some recipients
+// are rejected: the message is sent to the accepted ones. The returned
+// result contains the reply for each recipient and the reply after the
+// message data. See SendTransaction.
+func (c *Client) SendMailWithResult(from string, to []string, r io.Reader) (*TransactionResult, error) {
+	rcpts := make([]Recipient, len(to))
+	for i, addr := range to {
+		rcpts[i].Addr = addr
+	}
+	result, err := c.SendTransaction(from, nil, rcpts, r)
 	if err != nil {
-		return err
+		return result, err
 	}
-	return c.Quit()
+	return result, c.Quit()
 }
 
 var testHookStartTLS func(*tls.Config) // nil, except for tests
@@ -711,6 +1829,12 @@ var testHookStartTLS func(*tls.Config) // nil, except for tests
 // attachments (see the mime/multipart package or the go-message package), or
 // other mail functionality.
 func SendMail(addr string, a sasl.Client, from string, to []string, r io.Reader) error {
+	return SendMailContext(context.Background(), addr, a, from, to, r)
+}
+
+// SendMailContext is like SendMail, but uses ctx for dialing and for the
+// whole SMTP session.
+func SendMailContext(ctx context.Context, addr string, a sasl.Client, from string, to []string, r io.Reader) error {
 	if err := validateLine(from); err != nil {
 		return err
 	}
@@ -719,30 +1843,27 @@ func SendMail(addr string, a sasl.Client, from string, to []string, r io.Reader)
 			return err
 		}
 	}
-	c, err := Dial(addr)
+	c, err := DialContext(ctx, addr)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
-	if err = c.hello(); err != nil {
-		return err
-	}
-	if ok, _ := c.Extension("STARTTLS"); !ok {
-		return errors.New("smtp: server doesn't support STARTTLS")
-	}
-	if err = c.StartTLS(nil); err != nil {
-		return err
-	}
-	if a != nil && c.ext != nil {
-		if _, ok := c.ext["AUTH"]; !ok {
-			return errors.New("smtp: server doesn't support AUTH")
-		}
-		if err = c.Auth(a); err != nil {
+	c.TLSPolicy = TLSPolicyRequired
+	return c.withContext(ctx, func() error {
+		if err = c.hello(); err != nil {
 			return err
 		}
-	}
-	return c.SendMail(from, to, r)
+		if a != nil && c.ext != nil {
+			if _, ok := c.ext["AUTH"]; !ok {
+				return errors.New("smtp: server doesn't support AUTH")
+			}
+			if err = c.Auth(a); err != nil {
+				return err
+			}
+		}
+		return c.SendMail(from, to, r)
+	})
 }
 
 // Extension reports whether an extension is support by the server.
@@ -820,6 +1941,22 @@ func parseEnhancedCode(s string) (EnhancedCode, error) {
 	return code, nil
 }
 
+// parseMailboxes parses the mailboxes of a VRFY or EXPN reply, one per line,
+// stripping the enhanced status codes.
+func parseMailboxes(msg string) []string {
+	lines := strings.Split(msg, "\n")
+	for i, line := range lines {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if _, err := parseEnhancedCode(parts[0]); err == nil {
+			lines[i] = parts[1]
+		}
+	}
+	return lines
+}
+
 // toSMTPErr converts textproto.Error into SMTPError, parsing
 // enhanced status code if it is present.
 func toSMTPErr(protoErr *textproto.Error) *SMTPError {
@@ -7,10 +7,17 @@ package smtp
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"reflect"
 	"strings"
@@ -1003,3 +1010,1266 @@ Goodbye.`
 		t.Fatalf("QUIT failed: %s", err)
 	}
 }
+
+func TestClientDSN(t *testing.T) {
+	server := `220 hello world
+250-hello world
+250 DSN
+250 Sender OK
+250 Receiver OK
+`
+	server = strings.Join(strings.Split(server, "\n"), "\r\n")
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	if err := c.Mail("root@nsa.gov", &MailOptions{Return: DSNReturnFull, EnvelopeID: "QQ314159+1"}); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if err := c.RcptWithOptions("root@gchq.gov.uk", &RcptOptions{
+		Notify:            []DSNNotify{DSNNotifySuccess, DSNNotifyFailure},
+		OriginalRecipient: "root+dsn@gchq.gov.uk",
+	}); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+
+	want := "EHLO localhost\r\n" +
+		"MAIL FROM:<root@nsa.gov> RET=FULL ENVID=QQ314159+2B1\r\n" +
+		"RCPT TO:<root@gchq.gov.uk> NOTIFY=SUCCESS,FAILURE ORCPT=RFC822;root+2Bdsn@gchq.gov.uk\r\n"
+	if got := wrote.String(); got != want {
+		t.Fatalf("wrote %q; want %q", got, want)
+	}
+}
+
+func TestEncodeXtext(t *testing.T) {
+	tests := map[string]string{
+		"root@nsa.gov": "root@nsa.gov",
+		"a+b=c":        "a+2Bb+3Dc",
+		"a b%":         "a+20b%",
+	}
+	for raw, want := range tests {
+		if got := encodeXtext(raw); got != want {
+			t.Errorf("encodeXtext(%q) = %q; want %q", raw, got, want)
+		}
+		if decoded, err := decodeXtext(want); err != nil || decoded != raw {
+			t.Errorf("decodeXtext(%q) = %q, %v; want %q", want, decoded, err, raw)
+		}
+	}
+}
+
+func TestClientExpand(t *testing.T) {
+	server := `220 hello world
+250-hello world
+250 ENHANCEDSTATUSCODES
+250 2.1.5 Root <root@nsa.gov>
+250-2.1.5 Root <root@nsa.gov>
+250 2.1.5 <admin@nsa.gov>
+550 5.1.1 No such user here
+`
+	server = strings.Join(strings.Split(server, "\n"), "\r\n")
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	mailboxes, err := c.VerifyMailboxes("root")
+	if err != nil {
+		t.Fatalf("VRFY failed: %v", err)
+	}
+	if want := []string{"Root <root@nsa.gov>"}; !reflect.DeepEqual(mailboxes, want) {
+		t.Errorf("VRFY returned %q; want %q", mailboxes, want)
+	}
+
+	mailboxes, err = c.Expand("staff")
+	if err != nil {
+		t.Fatalf("EXPN failed: %v", err)
+	}
+	if want := []string{"Root <root@nsa.gov>", "<admin@nsa.gov>"}; !reflect.DeepEqual(mailboxes, want) {
+		t.Errorf("EXPN returned %q; want %q", mailboxes, want)
+	}
+
+	_, err = c.Expand("nobody")
+	if smtpErr, ok := err.(*SMTPError); !ok || smtpErr.Code != 550 {
+		t.Errorf("EXPN returned %v; want 550 error", err)
+	}
+
+	want := "EHLO localhost\r\n" +
+		"VRFY root\r\n" +
+		"EXPN staff\r\n" +
+		"EXPN nobody\r\n"
+	if got := wrote.String(); got != want {
+		t.Fatalf("wrote %q; want %q", got, want)
+	}
+}
+
+func TestClientBDAT(t *testing.T) {
+	server := `220 hello world
+250-hello world
+250-CHUNKING
+250-BINARYMIME
+250 8BITMIME
+250 Sender OK
+250 Receiver OK
+250 2.0.0 Chunk OK
+250 2.0.0 Chunk OK
+250 2.0.0 Message OK
+`
+	server = strings.Join(strings.Split(server, "\n"), "\r\n")
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c.ChunkSize = 5
+
+	if err := c.Mail("root@nsa.gov", &MailOptions{Body: BodyBinaryMIME}); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if err := c.Rcpt("root@gchq.gov.uk"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+
+	var status *SMTPError
+	w, err := c.Data(func(s *SMTPError) {
+		status = s
+	})
+	if err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	io.WriteString(w, "Hey ")
+	io.WriteString(w, "\x00.\r\n.\r\n<3")
+	if err := w.Close(); err != nil {
+		t.Fatalf("BDAT failed: %v", err)
+	}
+	if status == nil || status.Message != "Message OK" {
+		t.Fatalf("Invalid status: %v", status)
+	}
+
+	want := "EHLO localhost\r\n" +
+		"MAIL FROM:<root@nsa.gov> BODY=BINARYMIME\r\n" +
+		"RCPT TO:<root@gchq.gov.uk>\r\n" +
+		"BDAT 5\r\nHey \x00" +
+		"BDAT 5\r\n.\r\n.\r" +
+		"BDAT 3 LAST\r\n\n<3"
+	if got := wrote.String(); got != want {
+		t.Fatalf("wrote %q; want %q", got, want)
+	}
+}
+
+func TestClientBDAT_LMTP(t *testing.T) {
+	server := `220 localhost at your service
+250-localhost at your service
+250 CHUNKING
+250 Sender OK
+250 Receiver OK
+250 Receiver OK
+250 Chunk OK
+250 This recipient is fine
+500 But not this one
+`
+	server = strings.Join(strings.Split(server, "\n"), "\r\n")
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClientLMTP(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClientLMTP: %v", err)
+	}
+	c.ChunkSize = 5
+
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if err := c.Rcpt("root@gchq.gov.uk"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+	if err := c.Rcpt("root@bnd.bund.de"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+
+	var statuses []int
+	w, err := c.LMTPData(func(rcpt string, status *SMTPError) {
+		statuses = append(statuses, status.Code)
+	})
+	if err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	io.WriteString(w, "Hey <3")
+	if err := w.Close(); err != nil {
+		t.Fatalf("BDAT failed: %v", err)
+	}
+	if !reflect.DeepEqual(statuses, []int{250, 500}) {
+		t.Fatalf("Invalid statuses: %v", statuses)
+	}
+
+	want := "LHLO localhost\r\n" +
+		"MAIL FROM:<root@nsa.gov>\r\n" +
+		"RCPT TO:<root@gchq.gov.uk>\r\n" +
+		"RCPT TO:<root@bnd.bund.de>\r\n" +
+		"BDAT 5\r\nHey <" +
+		"BDAT 3 LAST\r\n3\r\n"
+	if got := wrote.String(); got != want {
+		t.Fatalf("wrote %q; want %q", got, want)
+	}
+}
+
+func TestClientBDAT_CRLF(t *testing.T) {
+	server := `220 hello world
+250-hello world
+250 CHUNKING
+250 Sender OK
+250 Receiver OK
+250 2.0.0 Message OK
+`
+	server = strings.Join(strings.Split(server, "\n"), "\r\n")
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if err := c.Rcpt("root@gchq.gov.uk"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+	w, err := c.Data(nil)
+	if err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	io.WriteString(w, "Subject: Hey\n\nLine 1\r")
+	io.WriteString(w, "\nLine 2\nLine 3")
+	if err := w.Close(); err != nil {
+		t.Fatalf("BDAT failed: %v", err)
+	}
+
+	want := "EHLO localhost\r\n" +
+		"MAIL FROM:<root@nsa.gov>\r\n" +
+		"RCPT TO:<root@gchq.gov.uk>\r\n" +
+		"BDAT 40 LAST\r\nSubject: Hey\r\n\r\nLine 1\r\nLine 2\r\nLine 3\r\n"
+	if got := wrote.String(); got != want {
+		t.Fatalf("wrote %q; want %q", got, want)
+	}
+}
+
+func TestClientBDAT_Error(t *testing.T) {
+	server := `220 hello world
+250-hello world
+250 CHUNKING
+250 Sender OK
+250 Receiver OK
+552 5.3.4 Message too big
+`
+	server = strings.Join(strings.Split(server, "\n"), "\r\n")
+
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		ioutil.Discard,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c.ChunkSize = 2
+
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if err := c.Rcpt("root@gchq.gov.uk"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+	w, err := c.Data(nil)
+	if err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	if _, err := io.WriteString(w, "Hey <3"); err == nil {
+		t.Fatal("BDAT succeeded")
+	}
+	err = w.Close()
+	if smtpErr, ok := err.(*SMTPError); !ok || smtpErr.Code != 552 {
+		t.Fatalf("Close returned %v; want 552 error", err)
+	}
+}
+
+func TestClientSendTransaction(t *testing.T) {
+	tests := []struct {
+		name   string
+		ext    string
+		server string
+		client string
+	}{
+		{
+			name: "pipelining",
+			ext:  "PIPELINING",
+			server: `250 Sender OK
+250 Receiver OK
+550 5.1.1 No such user
+250 Receiver OK
+354 Go ahead
+250 2.0.0 Message OK
+`,
+			client: `MAIL FROM:<root@nsa.gov>
+RCPT TO:<root@gchq.gov.uk>
+RCPT TO:<nobody@gchq.gov.uk>
+RCPT TO:<root@bnd.bund.de> NOTIFY=NEVER
+DATA
+Hey <3
+.
+`,
+		},
+		{
+			name: "lockstep",
+			ext:  "8BITMIME",
+			server: `250 Sender OK
+250 Receiver OK
+550 5.1.1 No such user
+250 Receiver OK
+354 Go ahead
+250 2.0.0 Message OK
+`,
+			client: `MAIL FROM:<root@nsa.gov> BODY=8BITMIME
+RCPT TO:<root@gchq.gov.uk>
+RCPT TO:<nobody@gchq.gov.uk>
+RCPT TO:<root@bnd.bund.de> NOTIFY=NEVER
+DATA
+Hey <3
+.
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := "220 hello world\n250-hello world\n250-DSN\n250 " + test.ext + "\n" + test.server
+			server = strings.Join(strings.Split(server, "\n"), "\r\n")
+			client := "EHLO localhost\n" + test.client
+			client = strings.Join(strings.Split(client, "\n"), "\r\n")
+
+			var wrote bytes.Buffer
+			var fake faker
+			fake.ReadWriter = struct {
+				io.Reader
+				io.Writer
+			}{
+				strings.NewReader(server),
+				&wrote,
+			}
+			c, err := NewClient(fake, "fake.host")
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+
+			rcpts := []Recipient{
+				{Addr: "root@gchq.gov.uk"},
+				{Addr: "nobody@gchq.gov.uk"},
+				{Addr: "root@bnd.bund.de", Opts: &RcptOptions{Notify: []DSNNotify{DSNNotifyNever}}},
+			}
+			result, err := c.SendTransaction("root@nsa.gov", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+			if err != nil {
+				t.Fatalf("SendTransaction: %v", err)
+			}
+			for i, res := range result.Recipients {
+				if res.Addr != rcpts[i].Addr {
+					t.Errorf("Invalid address for recipient #%v: %v", i, res.Addr)
+				}
+				if rejected := i == 1; rejected != (res.Err != nil) {
+					t.Errorf("Invalid error for recipient #%v: %v", i, res.Err)
+				}
+			}
+			if res := result.Recipients[1]; res.Err.Code != 550 || res.Err.Message != "No such user" {
+				t.Errorf("Invalid error: %v", res.Err)
+			}
+
+			if got := wrote.String(); got != client {
+				t.Fatalf("wrote %q; want %q", got, client)
+			}
+		})
+	}
+}
+
+func TestClientSendTransaction_NoValidRecipients(t *testing.T) {
+	server := `220 hello world
+250-hello world
+250 PIPELINING
+250 Sender OK
+550 5.1.1 No such user
+354 Go ahead
+554 5.5.1 No valid recipients
+250 2.0.0 Flushed
+`
+	server = strings.Join(strings.Split(server, "\n"), "\r\n")
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	rcpts := []Recipient{{Addr: "nobody@gchq.gov.uk"}}
+	result, err := c.SendTransaction("root@nsa.gov", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+	if err != ErrNoValidRecipients {
+		t.Fatalf("SendTransaction returned %v; want ErrNoValidRecipients", err)
+	}
+	if result == nil || result.Recipients[0].Err == nil {
+		t.Fatalf("Invalid result: %+v", result)
+	}
+
+	want := "EHLO localhost\r\n" +
+		"MAIL FROM:<root@nsa.gov>\r\n" +
+		"RCPT TO:<nobody@gchq.gov.uk>\r\n" +
+		"DATA\r\n" +
+		".\r\n" +
+		"RSET\r\n"
+	if got := wrote.String(); got != want {
+		t.Fatalf("wrote %q; want %q", got, want)
+	}
+}
+
+func TestClientSendTransaction_Reset(t *testing.T) {
+	tests := []struct {
+		name   string
+		ext    string
+		server string
+		client string
+	}{
+		{
+			name: "lockstep sender rejected",
+			ext:  "SIZE",
+			server: `550 5.7.1 Sender rejected
+250 2.0.0 Flushed
+`,
+			client: `MAIL FROM:<root@nsa.gov>
+RSET
+`,
+		},
+		{
+			name: "lockstep data rejected",
+			ext:  "SIZE",
+			server: `250 Sender OK
+250 Receiver OK
+451 4.3.0 Try again later
+250 2.0.0 Flushed
+`,
+			client: `MAIL FROM:<root@nsa.gov>
+RCPT TO:<root@gchq.gov.uk>
+DATA
+RSET
+`,
+		},
+		{
+			name: "pipelining sender rejected",
+			ext:  "PIPELINING",
+			server: `550 5.7.1 Sender rejected
+503 5.5.1 Need MAIL first
+503 5.5.1 Need MAIL first
+250 2.0.0 Flushed
+`,
+			client: `MAIL FROM:<root@nsa.gov>
+RCPT TO:<root@gchq.gov.uk>
+DATA
+RSET
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := "220 hello world\n250-hello world\n250 " + test.ext + "\n" + test.server
+			server = strings.Join(strings.Split(server, "\n"), "\r\n")
+			client := "EHLO localhost\n" + test.client
+			client = strings.Join(strings.Split(client, "\n"), "\r\n")
+
+			var wrote bytes.Buffer
+			var fake faker
+			fake.ReadWriter = struct {
+				io.Reader
+				io.Writer
+			}{
+				strings.NewReader(server),
+				&wrote,
+			}
+			c, err := NewClient(fake, "fake.host")
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+
+			rcpts := []Recipient{{Addr: "root@gchq.gov.uk"}}
+			_, err = c.SendTransaction("root@nsa.gov", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+			if _, ok := err.(*SMTPError); !ok {
+				t.Fatalf("SendTransaction returned %v; want SMTP error", err)
+			}
+			if got := wrote.String(); got != client {
+				t.Fatalf("wrote %q; want %q", got, client)
+			}
+		})
+	}
+}
+
+func TestClientSendMailWithResult(t *testing.T) {
+	server := `220 hello world
+250-hello world
+250 PIPELINING
+250 Sender OK
+250 Receiver OK
+450 4.2.1 Mailbox busy
+354 Go ahead
+554 5.6.0 Message rejected
+`
+	server = strings.Join(strings.Split(server, "\n"), "\r\n")
+
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		ioutil.Discard,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	to := []string{"root@gchq.gov.uk", "root@bnd.bund.de"}
+	result, err := c.SendMailWithResult("root@nsa.gov", to, strings.NewReader("Hey <3\r\n"))
+	if smtpErr, ok := err.(*SMTPError); !ok || smtpErr.Code != 554 {
+		t.Fatalf("SendMailWithResult returned %v; want 554 error", err)
+	}
+	if result.Data == nil || result.Data.Code != 554 {
+		t.Errorf("Invalid DATA status: %v", result.Data)
+	}
+	if res := result.Recipients[1]; res.Err == nil || res.Err.Code != 450 {
+		t.Errorf("Invalid RCPT error: %v", res.Err)
+	}
+}
+
+func TestClientSendTransaction_LMTP(t *testing.T) {
+	server := `220 localhost at your service
+250-localhost at your service
+250 PIPELINING
+250 Sender OK
+550 5.1.1 No such user
+250 Receiver OK
+250 Receiver OK
+354 Go ahead
+250 2.0.0 Delivered
+452 4.2.2 Mailbox full
+`
+	server = strings.Join(strings.Split(server, "\n"), "\r\n")
+
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		ioutil.Discard,
+	}
+	c, err := NewClientLMTP(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClientLMTP: %v", err)
+	}
+
+	rcpts := []Recipient{{Addr: "nobody@example.org"}, {Addr: "root@example.org"}, {Addr: "full@example.org"}}
+	result, err := c.SendTransaction("root@nsa.gov", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("SendTransaction: %v", err)
+	}
+
+	if res := result.Recipients[0]; res.Err == nil || res.Status != nil || res.Delivered() {
+		t.Errorf("Invalid result for rejected recipient: %+v", res)
+	}
+	if res := result.Recipients[1]; res.Status == nil || res.Status.Code != 250 || !res.Delivered() {
+		t.Errorf("Invalid result for delivered recipient: %+v", res)
+	}
+	if res := result.Recipients[2]; res.Status == nil || res.Status.Code != 452 || res.Delivered() {
+		t.Errorf("Invalid result for failed recipient: %+v", res)
+	}
+	if result.Data != nil {
+		t.Errorf("Unexpected DATA status: %v", result.Data)
+	}
+}
+
+type countingDialer struct {
+	net.Dialer
+	n int
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.n++
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+// hangingServer accepts connections, sends greeting and then never replies.
+func hangingServer(t *testing.T, greeting string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to create listener: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, greeting)
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	return l
+}
+
+func TestClientContext_Deadline(t *testing.T) {
+	l := hangingServer(t, "220 hello world\r\n")
+	defer l.Close()
+
+	d := &Dialer{NetDialer: &countingDialer{}}
+	c, err := d.DialContext(context.Background(), l.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer c.Close()
+	if n := d.NetDialer.(*countingDialer).n; n != 1 {
+		t.Errorf("Custom dialer called %v times", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = c.MailContext(ctx, "root@nsa.gov", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("MailContext returned %v; want deadline exceeded", err)
+	}
+}
+
+func TestClientContext_Cancel(t *testing.T) {
+	l := hangingServer(t, "")
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := DialContext(ctx, l.Addr().String())
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("DialContext returned %v; want canceled", err)
+	}
+}
+
+func TestClientTLSPolicy(t *testing.T) {
+	tests := []struct {
+		serverName string
+		verified   bool
+	}{
+		{"example.com", true},
+		{"wrong.example.org", false},
+	}
+	for _, test := range tests {
+		ln := newLocalListener(t)
+		errc := make(chan error, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				errc <- err
+				return
+			}
+			defer conn.Close()
+			errc <- serverHandle(conn, t, false)
+		}()
+
+		d := &Dialer{
+			TLSPolicy: TLSPolicyOpportunistic,
+			TLSConfig: &tls.Config{ServerName: test.serverName},
+		}
+		c, err := d.DialContext(context.Background(), ln.Addr().String())
+		if err != nil {
+			t.Fatalf("DialContext: %v", err)
+		}
+		if err := c.sendMail("joe1@example.com", []string{"joe2@example.com"}, strings.NewReader("Subject: test\n\nhowdy!")); err != nil {
+			t.Fatalf("sendMail: %v", err)
+		}
+
+		report := c.TLSReport()
+		if !report.Encrypted || report.Version == 0 || report.ServerName != test.serverName {
+			t.Errorf("Invalid TLS report for %v: %+v", test.serverName, report)
+		}
+		if report.Verified != test.verified || (report.VerifyError == nil) != test.verified {
+			t.Errorf("Invalid verification status for %v: %+v", test.serverName, report)
+		}
+		if err := c.StartTLS(nil); err == nil {
+			t.Errorf("StartTLS succeeded after TLS was started")
+		}
+
+		c.Quit()
+		if err := <-errc; err != nil {
+			t.Fatalf("server error: %v", err)
+		}
+		ln.Close()
+	}
+}
+
+func TestTLSReport_String(t *testing.T) {
+	tests := []struct {
+		report TLSReport
+		want   string
+	}{
+		{TLSReport{}, "no TLS"},
+		{
+			TLSReport{
+				Encrypted:   true,
+				Version:     tls.VersionTLS13,
+				CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+				Verified:    true,
+			},
+			"TLS 1.3 with cipher TLS_AES_128_GCM_SHA256, verified",
+		},
+		{
+			TLSReport{
+				Encrypted:   true,
+				Version:     tls.VersionTLS12,
+				CipherSuite: tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+				VerifyError: errors.New("bad certificate"),
+			},
+			"TLS 1.2 with cipher TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256, not verified (bad certificate)",
+		},
+		{
+			TLSReport{Encrypted: true, Version: 0x0305, CipherSuite: 0x1337},
+			"0x0305 with cipher 0x1337, not verified",
+		},
+	}
+	for _, test := range tests {
+		if got := test.report.String(); got != test.want {
+			t.Errorf("String() = %q; want %q", got, test.want)
+		}
+	}
+}
+
+func TestClientTLSPolicy_NoSTARTTLS(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+
+		send := smtpSender{conn}.send
+		send("220 hello world")
+		s := bufio.NewScanner(conn)
+		for s.Scan() {
+			switch s.Text() {
+			case "EHLO localhost":
+				send("250-hello world")
+				send("250 STARTTLS")
+			case "STARTTLS":
+				send("454 4.7.0 TLS not available")
+			case "MAIL FROM:<root@nsa.gov>":
+				send("250 Sender OK")
+			case "QUIT":
+				send("221 Bye")
+				errc <- nil
+				return
+			default:
+				errc <- fmt.Errorf("unrecognized command: %q", s.Text())
+				return
+			}
+		}
+		errc <- s.Err()
+	}()
+
+	d := &Dialer{TLSPolicy: TLSPolicyOpportunistic}
+	c, err := d.DialContext(context.Background(), ln.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+
+	// The session continues in cleartext
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if report := c.TLSReport(); report.Encrypted || report.String() != "no TLS" {
+		t.Errorf("Invalid TLS report: %+v", report)
+	}
+	c.Quit()
+	if err := <-errc; err != nil {
+		t.Fatalf("server error: %v", err)
+	}
+
+	server := "220 hello world\r\n250 hello world\r\n"
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		ioutil.Discard,
+	}
+	c, err = NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c.TLSPolicy = TLSPolicyRequired
+	if err := c.Mail("root@nsa.gov", nil); err == nil {
+		t.Fatal("MAIL succeeded without STARTTLS support")
+	}
+}
+
+func TestClientRequireTLS(t *testing.T) {
+	server := `220 hello world
+250-hello world
+250 REQUIRETLS
+`
+	server = strings.Join(strings.Split(server, "\n"), "\r\n")
+
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		ioutil.Discard,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	if err := c.Mail("root@nsa.gov", &MailOptions{RequireTLS: true}); err == nil {
+		t.Fatal("MAIL with REQUIRETLS succeeded without TLS")
+	}
+}
+
+type tlsaResolver struct {
+	records []TLSA
+	secure  bool
+	name    string
+}
+
+func (r *tlsaResolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, bool, error) {
+	r.name = name
+	return r.records, r.secure, nil
+}
+
+func TestClientDANE(t *testing.T) {
+	block, _ := pem.Decode(localhostCert)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spkiSHA256 := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	certSHA512 := sha512.Sum512(cert.Raw)
+
+	eeRecord := TLSA{TLSAUsageDANEEE, TLSASelectorSPKI, TLSAMatchingSHA256, spkiSHA256[:]}
+	taRecord := TLSA{TLSAUsageDANETA, TLSASelectorCert, TLSAMatchingSHA512, certSHA512[:]}
+	wrongRecord := TLSA{TLSAUsageDANEEE, TLSASelectorSPKI, TLSAMatchingSHA256, make([]byte, 32)}
+	pkixRecord := TLSA{TLSAUsagePKIXEE, TLSASelectorSPKI, TLSAMatchingSHA256, spkiSHA256[:]}
+
+	tests := []struct {
+		name       string
+		serverName string
+		records    []TLSA
+		secure     bool
+		match      *TLSA
+		fail       bool
+	}{
+		{
+			// DANE-EE doesn't check the name
+			name:       "EE",
+			serverName: "mx.example.org",
+			records:    []TLSA{wrongRecord, eeRecord},
+			secure:     true,
+			match:      &eeRecord,
+		},
+		{
+			name:       "TA",
+			serverName: "example.com",
+			records:    []TLSA{taRecord},
+			secure:     true,
+			match:      &taRecord,
+		},
+		{
+			name:       "TA wrong name",
+			serverName: "mx.example.org",
+			records:    []TLSA{taRecord},
+			secure:     true,
+			fail:       true,
+		},
+		{
+			name:       "mismatch",
+			serverName: "example.com",
+			records:    []TLSA{wrongRecord},
+			secure:     true,
+			fail:       true,
+		},
+		{
+			// PKIX usages aren't used for SMTP
+			name:       "unusable",
+			serverName: "mx.example.org",
+			records:    []TLSA{pkixRecord},
+			secure:     true,
+		},
+		{
+			name:       "insecure",
+			serverName: "mx.example.org",
+			records:    []TLSA{wrongRecord},
+			secure:     false,
+		},
+	}
+	for _, test := range tests {
+		ln := newLocalListener(t)
+		errc := make(chan error, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				errc <- err
+				return
+			}
+			defer conn.Close()
+			errc <- serverHandle(conn, t, false)
+		}()
+
+		resolver := &tlsaResolver{records: test.records, secure: test.secure}
+		d := &Dialer{
+			TLSPolicy: TLSPolicyOpportunistic,
+			TLSConfig: &tls.Config{ServerName: test.serverName},
+			DANE:      &DANE{Resolver: resolver},
+		}
+		c, err := d.DialContext(context.Background(), ln.Addr().String())
+		if err != nil {
+			t.Fatalf("%v: DialContext: %v", test.name, err)
+		}
+		err = c.sendMail("joe1@example.com", []string{"joe2@example.com"}, strings.NewReader("Subject: test\n\nhowdy!"))
+		if resolver.name != "_25._tcp."+test.serverName {
+			t.Errorf("%v: TLSA records looked up for %q", test.name, resolver.name)
+		}
+		if test.fail {
+			var daneErr *DANEError
+			if !errors.As(err, &daneErr) {
+				t.Errorf("%v: sendMail returned %v; want a DANE error", test.name, err)
+			}
+			<-errc
+			ln.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: sendMail: %v", test.name, err)
+		}
+
+		report := c.TLSReport()
+		if !report.Encrypted || report.Verified != (test.match != nil) {
+			t.Errorf("%v: invalid TLS report: %+v", test.name, report)
+		}
+		if test.match == nil && report.TLSA != nil {
+			t.Errorf("%v: TLS report has TLSA record %v; want none", test.name, report.TLSA)
+		} else if test.match != nil && (report.TLSA == nil || report.TLSA.String() != test.match.String()) {
+			t.Errorf("%v: TLS report has TLSA record %v; want %v", test.name, report.TLSA, test.match)
+		}
+
+		c.Quit()
+		if err := <-errc; err != nil {
+			t.Fatalf("%v: server error: %v", test.name, err)
+		}
+		ln.Close()
+	}
+}
+
+func TestClientDANE_NoSTARTTLS(t *testing.T) {
+	server := "220 hello world\r\n250 hello world\r\n"
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		ioutil.Discard,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c.TLSPolicy = TLSPolicyOpportunistic
+	c.DANE = &DANE{Resolver: &tlsaResolver{
+		records: []TLSA{{TLSAUsageDANEEE, TLSASelectorSPKI, TLSAMatchingSHA256, make([]byte, 32)}},
+		secure:  true,
+	}}
+
+	err = c.Mail("root@nsa.gov", nil)
+	if _, ok := err.(*DANEError); !ok {
+		t.Fatalf("MAIL returned %v; want a DANE error", err)
+	}
+}
+
+func TestClientStartTLS_DANE(t *testing.T) {
+	block, _ := pem.Decode(localhostCert)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := TLSA{TLSAUsageDANEEE, TLSASelectorCert, TLSAMatchingFull, cert.Raw}
+
+	ln := newLocalListener(t)
+	defer ln.Close()
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		errc <- serverHandle(conn, t, false)
+	}()
+
+	c, err := Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	c.DANE = &DANE{Resolver: &tlsaResolver{records: []TLSA{record}, secure: true}}
+	if err := c.hello(); err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	if err := c.StartTLS(&tls.Config{ServerName: "mx.example.org"}); err != nil {
+		t.Fatalf("StartTLS: %v", err)
+	}
+	if report := c.TLSReport(); !report.Verified || report.TLSA == nil {
+		t.Errorf("Invalid TLS report: %+v", report)
+	} else if !strings.Contains(report.String(), "DANE") {
+		t.Errorf("TLS report doesn't mention DANE: %v", report)
+	}
+
+	c.Quit()
+	if err := <-errc; err != nil {
+		t.Fatalf("server error: %v", err)
+	}
+}
+
+var authenticateServer = `220 hello world
+250-mx.example.org at your service
+250 AUTH PLAIN SCRAM-SHA-256 CRAM-MD5
+504 5.5.4 Mechanism not supported
+501 5.5.2 Syntax error
+334 PDE4OTYuNjk3MTcwOTUyQHBvc3RvZmZpY2UucmVzdG9uLm1jaS5uZXQ+
+235 2.7.0 Authentication successful
+`
+
+func TestClientAuthenticate(t *testing.T) {
+	server := strings.Join(strings.Split(authenticateServer, "\n"), "\r\n")
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	// SCRAM-SHA-256 is rejected, CRAM-MD5 is used instead of PLAIN
+	if err := c.Authenticate(&Credentials{Username: "tim", Password: "tanstaaftanstaaf"}); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+
+	cmds := strings.Split(wrote.String(), "\r\n")
+	if len(cmds) != 6 || !strings.HasPrefix(cmds[1], "AUTH SCRAM-SHA-256 ") || cmds[2] != "*" {
+		t.Fatalf("Invalid commands: %q", cmds)
+	}
+	if cmds[3] != "AUTH CRAM-MD5" || cmds[4] != "dGltIGI5MTNhNjAyYzdlZGE3YTQ5NWI0ZTZlNzMzNGQzODkw" {
+		t.Errorf("Invalid CRAM-MD5 exchange: %q", cmds[3:])
+	}
+}
+
+func TestClientAuthenticate_Insecure(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.example.org at your service\r\n" +
+		"250 AUTH PLAIN LOGIN\r\n" +
+		"235 2.7.0 Authentication successful\r\n"
+
+	for _, allowInsecure := range []bool{false, true} {
+		var wrote bytes.Buffer
+		var fake faker
+		fake.ReadWriter = struct {
+			io.Reader
+			io.Writer
+		}{
+			strings.NewReader(server),
+			&wrote,
+		}
+		c, err := NewClient(fake, "fake.host")
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+
+		creds := &Credentials{Username: "user", Password: "pass", AllowInsecure: allowInsecure}
+		err = c.Authenticate(creds)
+		if !allowInsecure {
+			if err == nil {
+				t.Error("Authenticate succeeded without TLS")
+			}
+			if wrote.String() != "EHLO localhost\r\n" {
+				t.Errorf("Credentials sent without TLS: %q", wrote.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Authenticate: %v", err)
+		}
+		if want := "EHLO localhost\r\nAUTH PLAIN AHVzZXIAcGFzcw==\r\n"; wrote.String() != want {
+			t.Errorf("Got:\n%s\nExpected:\n%s", wrote.String(), want)
+		}
+	}
+}
+
+func TestSCRAMClient(t *testing.T) {
+	// Test vectors from RFC 5802 section 5 and RFC 7677 section 3
+	tests := []struct {
+		mech, nonce                          string
+		serverFirst, clientFinal, serverLast string
+	}{
+		{
+			mech:        SCRAMSHA1,
+			nonce:       "fyko+d2lbbFgONRv9qkxdawL",
+			serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+			clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+			serverLast:  "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+		},
+		{
+			mech:        SCRAMSHA256,
+			nonce:       "rOprNGfwEbeRWgbNEkqO",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			serverLast:  "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+	}
+	for _, test := range tests {
+		a := &scramClient{mech: test.mech, username: "user", password: "pencil", clientNonce: test.nonce}
+		mech, ir, err := a.Start()
+		if err != nil || mech != test.mech || string(ir) != "n,,n=user,r="+test.nonce {
+			t.Fatalf("%v: Start returned %q, %q, %v", test.mech, mech, ir, err)
+		}
+		resp, err := a.Next([]byte(test.serverFirst))
+		if err != nil || string(resp) != test.clientFinal {
+			t.Fatalf("%v: Next returned %q, %v; want %q", test.mech, resp, err, test.clientFinal)
+		}
+		if _, err := a.Next([]byte(test.serverLast)); err != nil {
+			t.Errorf("%v: server signature rejected: %v", test.mech, err)
+		}
+	}
+
+	a := &scramClient{mech: SCRAMSHA256, username: "user", password: "pencil", clientNonce: "rOprNGfwEbeRWgbNEkqO"}
+	a.Start()
+	a.Next([]byte(tests[1].serverFirst))
+	if _, err := a.Next([]byte("v=" + base64.StdEncoding.EncodeToString(make([]byte, 32)))); err == nil {
+		t.Error("Invalid server signature accepted")
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read(b []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestPool_DataReaderError(t *testing.T) {
+	server := `220 hello world
+250-hello world
+250 SIZE
+250 Sender OK
+250 Receiver OK
+354 Go ahead
+`
+	server = strings.Join(strings.Split(server, "\n"), "\r\n")
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	p := &Pool{
+		Dial: func(ctx context.Context) (*Client, error) {
+			return NewClient(fake, "fake.host")
+		},
+	}
+	defer p.Close()
+
+	// The connection is in the middle of the message data: RSET would be
+	// sent as part of the message
+	r := io.MultiReader(strings.NewReader("Hey <3\r\n"), errReader{})
+	if err := p.SendMail(context.Background(), "root@nsa.gov", []string{"root@gchq.gov.uk"}, r); err == nil {
+		t.Fatal("SendMail succeeded with a failing reader")
+	}
+	if strings.Contains(wrote.String(), "RSET") {
+		t.Fatalf("wrote %q; want no RSET", wrote.String())
+	}
+	if len(p.idle) != 0 {
+		t.Fatal("Connection kept in the pool")
+	}
+}
@@ -1,6 +1,7 @@
 package smtp
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"net/textproto"
 	"regexp"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,6 +28,58 @@ type ConnectionState struct {
 	LocalAddr    net.Addr
 	RemoteAddr   net.Addr
 	TLS          tls.ConnectionState
+
+	// The PROXY protocol header received on the connection, if any.
+	Proxy *ProxyHeader
+
+	// Client attributes received with the XCLIENT command, if any. They
+	// override RemoteAddr, LocalAddr and Hostname.
+	XClient *ForwardedClient
+	// Client attributes received with the XFORWARD command for the current
+	// mail transaction, if any.
+	XForward *ForwardedClient
+
+	// The identity of the client authenticated with the AUTH command, if
+	// any. It is nil for mechanisms registered with Server.EnableAuth.
+	Auth *AuthIdentity
+}
+
+// AuthIdentity describes a client authenticated with the AUTH command.
+type AuthIdentity struct {
+	// SASL mechanism used by the client, e.g. "PLAIN".
+	Mechanism string
+	// Authentication identity, whose credentials were verified. It is empty
+	// for EXTERNAL, which relies on the TLS client certificate.
+	Username string
+	// Authorization identity the client acts as: the identity requested by
+	// the client and accepted by the backend, otherwise Username. It should
+	// be used to check the sender of messages.
+	Identity string
+}
+
+// ForwardedClient contains the attributes of the original client sent by a
+// trusted proxy with the XCLIENT or XFORWARD command. Attributes which were
+// not sent or which were unavailable are left empty.
+type ForwardedClient struct {
+	// Host name of the client, as found by reverse DNS.
+	Name string
+	Addr net.IP
+	Port int
+	// Protocol used by the client, SMTP or ESMTP.
+	Proto string
+	// Argument of the client HELO or EHLO command.
+	Helo string
+
+	// XCLIENT only: SASL login name of the client.
+	Login string
+	// XCLIENT only: server address and port the client connected to.
+	DestAddr net.IP
+	DestPort int
+
+	// XFORWARD only: local client identifier.
+	Ident string
+	// XFORWARD only: LOCAL or REMOTE.
+	Source string
 }
 
 type Conn struct {
@@ -34,6 +88,13 @@ type Conn struct {
 	server *Server
 	helo   string
 
+	// The PROXY protocol connection underlying conn, if any
+	proxy *proxyConn
+
+	// Whether AUTH was removed from the EHLO capabilities by HelloBackend.
+	// It stays set until the session is reset by STARTTLS or XCLIENT.
+	authHidden bool
+
 	// Number of errors witnessed on this connection
 	errCount int
 
@@ -50,6 +111,20 @@ type Conn struct {
 	fromReceived bool
 	recipients   []string
 	didAuth      bool
+	authIdentity *AuthIdentity
+
+	// Whether the connection is waiting for the next command
+	idle bool
+
+	xclient  *ForwardedClient
+	xforward *ForwardedClient
+
+	// Cancelled when the connection is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Cancelled when the current mail transaction is reset
+	txCtx    context.Context
+	txCancel context.CancelFunc
 }
 
 func newConn(c net.Conn, s *Server) *Conn {
@@ -57,6 +132,8 @@ func newConn(c net.Conn, s *Server) *Conn {
 		server: s,
 		conn:   c,
 	}
+	sc.ctx, sc.cancel = context.WithCancel(context.Background())
+	sc.txCtx, sc.txCancel = context.WithCancel(sc.ctx)
 
 	sc.init()
 	return sc
@@ -115,7 +192,11 @@ func (c *Conn) handle(cmd string, arg string) {
 
 	cmd = strings.ToUpper(cmd)
 	switch cmd {
-	case "SEND", "SOML", "SAML", "EXPN", "HELP", "TURN":
+	case "SEND", "SOML", "SAML", "HELP", "TURN":
+		if h, ok := c.server.commands[cmd]; ok {
+			c.handleCustom(h, arg)
+			return
+		}
 		// These commands are not implemented in any state
 		c.WriteResponse(502, EnhancedCode{5, 5, 1}, fmt.Sprintf("%v command not implemented", cmd))
 	case "HELO", "EHLO", "LHLO":
@@ -135,7 +216,13 @@ func (c *Conn) handle(cmd string, arg string) {
 	case "RCPT":
 		c.handleRcpt(arg)
 	case "VRFY":
-		c.WriteResponse(252, EnhancedCode{2, 5, 0}, "Cannot VRFY user, but will accept message")
+		c.handleVrfy(arg)
+	case "EXPN":
+		if h, ok := c.server.commands[cmd]; ok {
+			c.handleCustom(h, arg)
+			return
+		}
+		c.handleExpn(arg)
 	case "NOOP":
 		c.WriteResponse(250, EnhancedCode{2, 0, 0}, "I have sucessfully done nothing")
 	case "RSET": // Reset session
@@ -158,13 +245,37 @@ func (c *Conn) handle(cmd string, arg string) {
 		}
 	case "STARTTLS":
 		c.handleStartTLS()
+	case "XCLIENT":
+		c.handleXClient(arg)
+	case "XFORWARD":
+		c.handleXForward(arg)
 	default:
+		if h, ok := c.server.commands[cmd]; ok {
+			c.handleCustom(h, arg)
+			return
+		}
 		msg := fmt.Sprintf("Syntax errors, %v command unrecognized", cmd)
 		c.server.ErrorLog.Printf(c, "%s", msg)
 		c.protocolError(500, EnhancedCode{5, 5, 2}, msg)
 	}
 }
 
+func (c *Conn) handleCustom(h CommandHandler, arg string) {
+	err := h(c, arg, c.Session())
+	if err == nil {
+		return
+	}
+	smtpErr, ok := err.(*SMTPError)
+	if !ok {
+		c.protocolError(501, EnhancedCode{5, 5, 4}, err.Error())
+	} else if smtpErr.Code == 500 || smtpErr.Code == 501 {
+		c.protocolError(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+	} else {
+		// Negative replies such as policy rejections are not client errors
+		c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+	}
+}
+
 func (c *Conn) Server() *Server {
 	return c.server
 }
@@ -182,10 +293,35 @@ func (c *Conn) SetSession(session Session) {
 	c.session = session
 }
 
+// login sets the session of a client authenticated with a built-in SASL
+// mechanism. identity is the authorization identity requested by the client,
+// if any.
+func (c *Conn) login(session Session, mech, username, identity string) {
+	if identity == "" {
+		identity = username
+	}
+	c.SetSession(session)
+	c.authIdentity = &AuthIdentity{
+		Mechanism: mech,
+		Username:  username,
+		Identity:  identity,
+	}
+}
+
+// Context returns the context of the current mail transaction. It is
+// cancelled when the transaction is reset or the connection is closed.
+func (c *Conn) Context() context.Context {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.txCtx
+}
+
 func (c *Conn) Close() error {
 	c.locker.Lock()
 	defer c.locker.Unlock()
 
+	c.cancel()
+
 	if c.bdatPipe != nil {
 		c.bdatPipe.CloseWithError(ErrDataReset)
 		c.bdatPipe = nil
@@ -220,10 +356,33 @@ func (c *Conn) State() ConnectionState {
 	state.Hostname = c.helo
 	state.LocalAddr = c.conn.LocalAddr()
 	state.RemoteAddr = c.conn.RemoteAddr()
+	if pc := c.proxy; pc != nil && pc.readHeader() == nil {
+		state.Proxy = pc.header
+	}
+
+	if xc := c.xclient; xc != nil {
+		state.XClient = xc
+		if xc.Addr != nil {
+			state.RemoteAddr = &net.TCPAddr{IP: xc.Addr, Port: xc.Port}
+		}
+		if xc.DestAddr != nil {
+			state.LocalAddr = &net.TCPAddr{IP: xc.DestAddr, Port: xc.DestPort}
+		}
+		if xc.Helo != "" {
+			state.Hostname = xc.Helo
+		}
+	}
+	state.XForward = c.xforward
+	state.Auth = c.authIdentity
 
 	return state
 }
 
+// xclientAllowed reports whether the peer may use XCLIENT and XFORWARD.
+func (c *Conn) xclientAllowed() bool {
+	return c.server.TrustedPeer != nil && c.server.TrustedPeer(c.conn.RemoteAddr())
+}
+
 func (c *Conn) authAllowed() bool {
 	_, isTLS := c.TLSConnectionState()
 	return !c.server.AuthDisabled && (isTLS || c.server.AllowInsecureAuth)
@@ -249,6 +408,10 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 			c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Domain/address argument required for HELO")
 			return
 		}
+		if _, err := c.hello(domain, nil); err != nil {
+			c.writeHelloError(err)
+			return
+		}
 		c.helo = domain
 
 		c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("Hello %s", domain))
@@ -259,8 +422,6 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 			return
 		}
 
-		c.helo = domain
-
 		caps := []string{}
 		caps = append(caps, c.server.caps...)
 		if _, isTLS := c.TLSConnectionState(); c.server.TLSConfig != nil && !isTLS {
@@ -268,7 +429,7 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 		}
 		if c.authAllowed() {
 			authCap := "AUTH"
-			for name := range c.server.auths {
+			for _, name := range c.server.authMechanisms(c) {
 				authCap += " " + name
 			}
 
@@ -283,11 +444,31 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 		if c.server.EnableBINARYMIME {
 			caps = append(caps, "BINARYMIME")
 		}
+		if c.server.EnableDSN {
+			caps = append(caps, "DSN")
+		}
+		if c.server.EnableXCLIENT && c.xclientAllowed() {
+			caps = append(caps, "XCLIENT NAME ADDR PORT PROTO HELO LOGIN DESTADDR DESTPORT")
+		}
+		if c.server.EnableXFORWARD && c.xclientAllowed() {
+			caps = append(caps, "XFORWARD NAME ADDR PORT PROTO HELO IDENT SOURCE")
+		}
 		if c.server.MaxMessageBytes > 0 {
 			caps = append(caps, fmt.Sprintf("SIZE %v", c.server.MaxMessageBytes))
 		} else {
 			caps = append(caps, "SIZE")
 		}
+		caps = append(caps, c.extensionCaps()...)
+
+		caps, err = c.hello(domain, caps)
+		if err != nil {
+			c.writeHelloError(err)
+			return
+		}
+		c.helo = domain
+		if c.authAllowed() && !hasCapability(caps, "AUTH") {
+			c.authHidden = true
+		}
 
 		args := []string{"Hello " + domain}
 		args = append(args, caps...)
@@ -295,13 +476,46 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 	}
 }
 
+// hello calls HelloBackend, if implemented by the backend. caps is nil for
+// HELO.
+func (c *Conn) hello(domain string, caps []string) ([]string, error) {
+	hb, ok := c.server.Backend.(HelloBackend)
+	if !ok {
+		return caps, nil
+	}
+	state := c.State()
+	return hb.Hello(&state, domain, caps)
+}
+
+func (c *Conn) writeHelloError(err error) {
+	if smtpErr, ok := err.(*SMTPError); ok {
+		c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+	} else {
+		c.WriteResponse(550, EnhancedCode{5, 7, 1}, err.Error())
+	}
+}
+
+// hasCapability reports whether the EHLO keyword name is in caps.
+func hasCapability(caps []string, name string) bool {
+	for _, line := range caps {
+		keyword := line
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			keyword = line[:i]
+		}
+		if strings.EqualFold(keyword, name) {
+			return true
+		}
+	}
+	return false
+}
+
 // READY state -> waiting for MAIL
 func (c *Conn) handleMail(arg string) {
 	if c.helo == "" {
 		c.WriteResponse(502, EnhancedCode{2, 5, 1}, "Please introduce yourself first.")
 		return
 	}
-	if c.bdatPipe != nil {
+	if c.inTransfer() {
 		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "MAIL not allowed during message transfer")
 		return
 	}
@@ -378,6 +592,10 @@ func (c *Conn) handleMail(arg string) {
 					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "REQUIRETLS is not implemented")
 					return
 				}
+				if _, isTLS := c.TLSConnectionState(); !isTLS {
+					c.WriteResponse(530, EnhancedCode{5, 7, 10}, "REQUIRETLS needs a TLS connection")
+					return
+				}
 				opts.RequireTLS = true
 			case "BODY":
 				switch value {
@@ -409,14 +627,45 @@ func (c *Conn) handleMail(arg string) {
 				}
 				decodedMbox := value[1 : len(value)-1]
 				opts.Auth = &decodedMbox
+			case "RET":
+				if !c.server.EnableDSN {
+					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "DSN is not implemented")
+					return
+				}
+				switch DSNReturn(strings.ToUpper(value)) {
+				case DSNReturnFull:
+					opts.Return = DSNReturnFull
+				case DSNReturnHeaders:
+					opts.Return = DSNReturnHeaders
+				default:
+					c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unknown RET value")
+					return
+				}
+			case "ENVID":
+				if !c.server.EnableDSN {
+					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "DSN is not implemented")
+					return
+				}
+				value, err := decodeXtext(value)
+				if err != nil || value == "" {
+					c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Malformed ENVID parameter value")
+					return
+				}
+				opts.EnvelopeID = value
 			default:
-				c.WriteResponse(500, EnhancedCode{5, 5, 4}, "Unknown MAIL FROM argument")
-				return
+				f, ok := c.server.mailParams[key]
+				if !ok {
+					c.WriteResponse(500, EnhancedCode{5, 5, 4}, "Unknown MAIL FROM argument")
+					return
+				}
+				if !c.handleParam(f, key, value, &opts.Extensions) {
+					return
+				}
 			}
 		}
 	}
 
-	if err := c.Session().Mail(from, opts); err != nil {
+	if err := c.sessionMail(from, opts); err != nil {
 		if smtpErr, ok := err.(*SMTPError); ok {
 			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
 			if smtpErr.Code == 250 {
@@ -468,28 +717,98 @@ func encodeXtext(raw string) string {
 	var out strings.Builder
 	out.Grow(len(raw))
 
-	for _, ch := range raw {
-		if ch == '+' || ch == '=' {
-			out.WriteRune('+')
-			out.WriteString(strings.ToUpper(strconv.FormatInt(int64(ch), 16)))
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		if ch != '+' && ch != '=' && ch >= '!' && ch <= '~' { // printable non-space US-ASCII
+			out.WriteByte(ch)
+			continue
 		}
-		if ch > '!' && ch < '~' { // printable non-space US-ASCII
-			out.WriteRune(ch)
-		}
-		// Non-ASCII.
-		out.WriteRune('+')
-		out.WriteString(strings.ToUpper(strconv.FormatInt(int64(ch), 16)))
+		out.WriteString(fmt.Sprintf("+%02X", ch))
 	}
 	return out.String()
 }
 
+// extensionCaps returns the EHLO keywords registered with
+// Server.EnableCapability, sorted by name.
+func (c *Conn) extensionCaps() []string {
+	names := make([]string, 0, len(c.server.extCaps))
+	for name := range c.server.extCaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var caps []string
+	for _, name := range names {
+		line := name
+		if f := c.server.extCaps[name]; f != nil {
+			line = f(c)
+		}
+		if line != "" {
+			caps = append(caps, line)
+		}
+	}
+	return caps
+}
+
+// handleParam parses an extension parameter with f and stores its value in
+// exts. It returns false if the parameter was rejected, in which case the
+// reply has already been written.
+func (c *Conn) handleParam(f ParamFunc, key, value string, exts *map[string]string) bool {
+	v, err := f(c, value)
+	if err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+		} else {
+			c.WriteResponse(501, EnhancedCode{5, 5, 4}, err.Error())
+		}
+		return false
+	}
+	if *exts == nil {
+		*exts = make(map[string]string)
+	}
+	(*exts)[key] = v
+	return true
+}
+
+func parseDSNNotify(value string) ([]DSNNotify, error) {
+	var notify []DSNNotify
+	never := false
+	for _, v := range strings.Split(value, ",") {
+		switch n := DSNNotify(strings.ToUpper(v)); n {
+		case DSNNotifyNever:
+			never = true
+			notify = append(notify, n)
+		case DSNNotifySuccess, DSNNotifyFailure, DSNNotifyDelayed:
+			notify = append(notify, n)
+		default:
+			return nil, errors.New("Unknown NOTIFY value")
+		}
+	}
+	if never && len(notify) > 1 {
+		return nil, errors.New("NEVER cannot be combined with other NOTIFY values")
+	}
+	return notify, nil
+}
+
+func parseDSNOriginalRecipient(value string) (DSNAddressType, string, error) {
+	parts := strings.SplitN(value, ";", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", errors.New("Malformed ORCPT parameter value")
+	}
+	addr, err := decodeXtext(parts[1])
+	if err != nil || addr == "" {
+		return "", "", errors.New("Malformed ORCPT parameter value")
+	}
+	return DSNAddressType(strings.ToUpper(parts[0])), addr, nil
+}
+
 // MAIL state -> waiting for RCPTs followed by DATA
 func (c *Conn) handleRcpt(arg string) {
 	if !c.fromReceived {
 		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "Missing MAIL FROM command.")
 		return
 	}
-	if c.bdatPipe != nil {
+	if c.inTransfer() {
 		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "RCPT not allowed during message transfer")
 		return
 	}
@@ -499,15 +818,66 @@ func (c *Conn) handleRcpt(arg string) {
 		return
 	}
 
-	// TODO: This trim is probably too forgiving
-	recipient := strings.Trim(arg[3:], "<> ")
+	rcptArgs := strings.Split(strings.Trim(arg[3:], " "), " ")
+	recipient, err := parseRcptPath(rcptArgs[0], c.server.Strict)
+	if err != nil {
+		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting RCPT arg syntax of TO:<address>")
+		return
+	}
+
+	opts := &RcptOptions{}
+
+	if len(rcptArgs) > 1 {
+		args, err := parseArgs(rcptArgs[1:])
+		if err != nil {
+			c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unable to parse RCPT ESMTP parameters")
+			return
+		}
+
+		for key, value := range args {
+			switch key {
+			case "NOTIFY":
+				if !c.server.EnableDSN {
+					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "DSN is not implemented")
+					return
+				}
+				notify, err := parseDSNNotify(value)
+				if err != nil {
+					c.WriteResponse(501, EnhancedCode{5, 5, 4}, err.Error())
+					return
+				}
+				opts.Notify = notify
+			case "ORCPT":
+				if !c.server.EnableDSN {
+					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "DSN is not implemented")
+					return
+				}
+				typ, addr, err := parseDSNOriginalRecipient(value)
+				if err != nil {
+					c.WriteResponse(501, EnhancedCode{5, 5, 4}, err.Error())
+					return
+				}
+				opts.OriginalRecipientType = typ
+				opts.OriginalRecipient = addr
+			default:
+				f, ok := c.server.rcptParams[key]
+				if !ok {
+					c.WriteResponse(555, EnhancedCode{5, 5, 4}, "Unknown RCPT TO argument")
+					return
+				}
+				if !c.handleParam(f, key, value, &opts.Extensions) {
+					return
+				}
+			}
+		}
+	}
 
 	if c.server.MaxRecipients > 0 && len(c.recipients) >= c.server.MaxRecipients {
 		c.WriteResponse(552, EnhancedCode{5, 5, 3}, fmt.Sprintf("Maximum limit of %v recipients reached", c.server.MaxRecipients))
 		return
 	}
 
-	if err := c.Session().Rcpt(recipient); err != nil {
+	if err := c.sessionRcpt(recipient, opts); err != nil {
 		if smtpErr, ok := err.(*SMTPError); ok {
 			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
 			if smtpErr.Code == 250 {
@@ -522,6 +892,55 @@ func (c *Conn) handleRcpt(arg string) {
 	c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("I'll make sure <%v> gets this", recipient))
 }
 
+func (c *Conn) handleVrfy(arg string) {
+	vs, ok := c.Session().(VerifySession)
+	if !ok {
+		c.WriteResponse(252, EnhancedCode{2, 5, 0}, "Cannot VRFY user, but will accept message")
+		return
+	}
+	if arg == "" {
+		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting VRFY arg syntax of VRFY <string>")
+		return
+	}
+
+	mailboxes, err := vs.Verify(arg)
+	c.writeMailboxes(mailboxes, err)
+}
+
+func (c *Conn) handleExpn(arg string) {
+	es, ok := c.Session().(ExpandSession)
+	if !ok {
+		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "EXPN command not implemented")
+		return
+	}
+	if arg == "" {
+		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting EXPN arg syntax of EXPN <string>")
+		return
+	}
+
+	mailboxes, err := es.Expand(arg)
+	c.writeMailboxes(mailboxes, err)
+}
+
+// writeMailboxes writes the reply to a VRFY or EXPN command, one mailbox per
+// line.
+func (c *Conn) writeMailboxes(mailboxes []string, err error) {
+	if err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			return
+		}
+		// Don't leak internal errors to clients
+		c.WriteResponse(451, EnhancedCode{4, 3, 0}, "Requested action aborted: local error in processing")
+		return
+	}
+	if len(mailboxes) == 0 {
+		c.WriteResponse(550, EnhancedCode{5, 1, 1}, "No such user here")
+		return
+	}
+	c.WriteResponse(250, EnhancedCode{2, 1, 5}, mailboxes...)
+}
+
 func (c *Conn) handleAuth(arg string) {
 	if c.helo == "" {
 		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "Please introduce yourself first.")
@@ -531,6 +950,10 @@ func (c *Conn) handleAuth(arg string) {
 		c.WriteResponse(503, EnhancedCode{5, 5, 1}, "Already authenticated")
 		return
 	}
+	if c.authHidden {
+		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "AUTH not available")
+		return
+	}
 
 	parts := strings.Fields(arg)
 	if len(parts) == 0 {
@@ -547,7 +970,10 @@ func (c *Conn) handleAuth(arg string) {
 
 	// Parse client initial response if there is one
 	var ir []byte
-	if len(parts) > 1 {
+	if len(parts) > 1 && parts[1] == "=" {
+		// Empty initial response (RFC 4954 section 4)
+		ir = []byte{}
+	} else if len(parts) > 1 {
 		var err error
 		ir, err = base64.StdEncoding.DecodeString(parts[1])
 		if err != nil {
@@ -555,8 +981,8 @@ func (c *Conn) handleAuth(arg string) {
 		}
 	}
 
-	newSasl, ok := c.server.auths[mechanism]
-	if !ok {
+	newSasl := c.server.authFactory(c, mechanism)
+	if newSasl == nil {
 		c.WriteResponse(504, EnhancedCode{5, 7, 4}, "Unsupported authentication mechanism")
 		return
 	}
@@ -655,8 +1081,153 @@ func (c *Conn) handleStartTLS() {
 		c.SetSession(nil)
 	}
 	c.helo = ""
+	c.authHidden = false
+	c.didAuth = false
+	c.authIdentity = nil
+	c.reset()
+}
+
+// parseForwardedClient fills a ForwardedClient from XCLIENT or XFORWARD
+// attributes. Only the attributes listed in allowed are accepted.
+func parseForwardedClient(fc *ForwardedClient, arg string, allowed ...string) error {
+	attrs, err := parseXClientArgs(arg)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range attrs {
+		known := false
+		for _, a := range allowed {
+			if a == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("Bad attribute name: %v", name)
+		}
+
+		switch name {
+		case "NAME":
+			fc.Name = value
+		case "ADDR", "DESTADDR":
+			var ip net.IP
+			if value != "" {
+				ip = net.ParseIP(strings.TrimPrefix(strings.ToUpper(value), "IPV6:"))
+				if ip == nil {
+					return fmt.Errorf("Bad %v value: %v", name, value)
+				}
+			}
+			if name == "ADDR" {
+				fc.Addr = ip
+			} else {
+				fc.DestAddr = ip
+			}
+		case "PORT", "DESTPORT":
+			var port uint64
+			if value != "" {
+				port, err = strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					return fmt.Errorf("Bad %v value: %v", name, value)
+				}
+			}
+			if name == "PORT" {
+				fc.Port = int(port)
+			} else {
+				fc.DestPort = int(port)
+			}
+		case "PROTO":
+			fc.Proto = strings.ToUpper(value)
+		case "HELO":
+			fc.Helo = value
+		case "LOGIN":
+			fc.Login = value
+		case "IDENT":
+			fc.Ident = value
+		case "SOURCE":
+			fc.Source = strings.ToUpper(value)
+		}
+	}
+	return nil
+}
+
+// XCLIENT, as defined in http://www.postfix.org/XCLIENT_README.html
+func (c *Conn) handleXClient(arg string) {
+	if !c.server.EnableXCLIENT {
+		msg := "Syntax error, XCLIENT command unrecognized"
+		c.server.ErrorLog.Printf(c, "%s", msg)
+		c.protocolError(500, EnhancedCode{5, 5, 2}, msg)
+		return
+	}
+	if !c.xclientAllowed() {
+		c.WriteResponse(550, EnhancedCode{5, 7, 0}, "Insufficient authorization")
+		return
+	}
+	if c.fromReceived || c.inTransfer() {
+		c.WriteResponse(503, EnhancedCode{5, 5, 1}, "MAIL transaction in progress")
+		return
+	}
+
+	xc := &ForwardedClient{}
+	if c.xclient != nil {
+		*xc = *c.xclient
+	}
+	err := parseForwardedClient(xc, arg, "NAME", "ADDR", "PORT", "PROTO", "HELO", "LOGIN", "DESTADDR", "DESTPORT")
+	if err != nil {
+		c.WriteResponse(501, EnhancedCode{5, 5, 4}, err.Error())
+		return
+	}
+
+	// The proxied client starts a new SMTP session: close the previous
+	// Session and greet the client again.
+	if session := c.Session(); session != nil {
+		session.Logout()
+		c.SetSession(nil)
+	}
+	// The client must send EHLO again after the greeting. The forwarded
+	// HELO name is reported by State.
+	c.xclient = xc
+	c.helo = ""
+	c.authHidden = false
 	c.didAuth = false
+	c.authIdentity = nil
 	c.reset()
+
+	if !c.greet() {
+		// The connection was closed, handleConn stops reading commands
+		return
+	}
+}
+
+// XFORWARD, as defined in http://www.postfix.org/XFORWARD_README.html
+func (c *Conn) handleXForward(arg string) {
+	if !c.server.EnableXFORWARD {
+		msg := "Syntax error, XFORWARD command unrecognized"
+		c.server.ErrorLog.Printf(c, "%s", msg)
+		c.protocolError(500, EnhancedCode{5, 5, 2}, msg)
+		return
+	}
+	if !c.xclientAllowed() {
+		c.WriteResponse(550, EnhancedCode{5, 7, 0}, "Insufficient authorization")
+		return
+	}
+	if c.fromReceived || c.inTransfer() {
+		c.WriteResponse(503, EnhancedCode{5, 5, 1}, "MAIL transaction in progress")
+		return
+	}
+
+	xf := &ForwardedClient{}
+	if c.xforward != nil {
+		*xf = *c.xforward
+	}
+	err := parseForwardedClient(xf, arg, "NAME", "ADDR", "PORT", "PROTO", "HELO", "IDENT", "SOURCE")
+	if err != nil {
+		c.WriteResponse(501, EnhancedCode{5, 5, 4}, err.Error())
+		return
+	}
+	c.xforward = xf
+
+	c.WriteResponse(250, EnhancedCode{2, 0, 0}, "Ok")
 }
 
 // DATA
@@ -665,7 +1236,7 @@ func (c *Conn) handleData(arg string) {
 		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "DATA command should not have any arguments")
 		return
 	}
-	if c.bdatPipe != nil {
+	if c.inTransfer() {
 		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "DATA not allowed during message transfer")
 		return
 	}
@@ -689,7 +1260,7 @@ func (c *Conn) handleData(arg string) {
 	}
 
 	r := newDataReader(c)
-	err := c.Session().Data(r)
+	err := c.sessionData(c.Context(), r)
 	code, enhancedCode, msg := toSMTPStatus(err)
 	if err == ErrDataTimeout {
 		// don't copy the data, write response and close the connection
@@ -751,12 +1322,20 @@ func (c *Conn) handleBdat(arg string) {
 		c.bdatStatus = c.createStatusCollector()
 	}
 
-	if c.bdatPipe == nil {
+	// The pipe is also accessed by Close and Server.Shutdown
+	c.locker.Lock()
+	pipe := c.bdatPipe
+	c.locker.Unlock()
+	if pipe == nil {
 		var r *io.PipeReader
-		r, c.bdatPipe = io.Pipe()
+		r, pipe = io.Pipe()
+		c.locker.Lock()
+		c.bdatPipe = pipe
+		c.locker.Unlock()
 
 		c.dataResult = make(chan error, 1)
 
+		ctx := c.Context()
 		go func() {
 			defer func() {
 				if err := recover(); err != nil {
@@ -769,11 +1348,11 @@ func (c *Conn) handleBdat(arg string) {
 
 			var err error
 			if !c.server.LMTP {
-				err = c.Session().Data(r)
+				err = c.sessionData(ctx, r)
 			} else {
 				lmtpSession, ok := c.Session().(LMTPSession)
 				if !ok {
-					err = c.Session().Data(r)
+					err = c.sessionData(ctx, r)
 					for _, rcpt := range c.recipients {
 						c.bdatStatus.SetStatus(rcpt, err)
 					}
@@ -790,7 +1369,7 @@ func (c *Conn) handleBdat(arg string) {
 	c.lineLimitReader.LineLimit = 0
 
 	chunk := io.LimitReader(c.text.R, int64(size))
-	_, err = io.Copy(c.bdatPipe, chunk)
+	_, err = io.Copy(pipe, chunk)
 	if err != nil {
 		// Backend might return an error early using CloseWithError without consuming
 		// the whole chunk.
@@ -812,7 +1391,10 @@ func (c *Conn) handleBdat(arg string) {
 	if last {
 		c.lineLimitReader.LineLimit = c.server.MaxLineLength
 
-		c.bdatPipe.Close()
+		c.locker.Lock()
+		c.bdatPipe = nil
+		c.locker.Unlock()
+		pipe.Close()
 
 		err := <-c.dataResult
 
@@ -837,6 +1419,8 @@ func (c *Conn) handleBdat(arg string) {
 	}
 }
 
+var errShuttingDown = errors.New("smtp: server is shutting down")
+
 // ErrDataReset is returned by Reader pased to Data function if client does not
 // send another BDAT command and instead closes connection or issues RSET command.
 var ErrDataReset = errors.New("smtp: message transmission aborted")
@@ -929,7 +1513,7 @@ func (c *Conn) handleDataLMTP() {
 	lmtpSession, ok := c.Session().(LMTPSession)
 	if !ok {
 		// Fallback to using a single status for all recipients.
-		err := c.Session().Data(r)
+		err := c.sessionData(c.Context(), r)
 		io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
 		for _, rcpt := range c.recipients {
 			status.SetStatus(rcpt, err)
@@ -969,6 +1553,33 @@ func (c *Conn) handleDataLMTP() {
 	}
 }
 
+func (c *Conn) sessionMail(from string, opts *MailOptions) error {
+	session := c.Session()
+	if cs, ok := session.(ContextSession); ok {
+		return cs.MailContext(c.Context(), from, opts)
+	}
+	return session.Mail(from, opts)
+}
+
+func (c *Conn) sessionRcpt(to string, opts *RcptOptions) error {
+	session := c.Session()
+	if cs, ok := session.(ContextSession); ok {
+		return cs.RcptContext(c.Context(), to, opts)
+	}
+	if rs, ok := session.(RcptOptionsSession); ok {
+		return rs.RcptWithOptions(to, opts)
+	}
+	return session.Rcpt(to)
+}
+
+func (c *Conn) sessionData(ctx context.Context, r io.Reader) error {
+	session := c.Session()
+	if cs, ok := session.(ContextSession); ok {
+		return cs.DataContext(ctx, r)
+	}
+	return session.Data(r)
+}
+
 func toSMTPStatus(err error) (code int, enchCode EnhancedCode, msg string) {
 	if err != nil {
 		if smtperr, ok := err.(*SMTPError); ok {
@@ -986,8 +1597,31 @@ func (c *Conn) Reject() {
 	c.Close()
 }
 
-func (c *Conn) greet() {
-	c.WriteResponse(220, NoEnhancedCode, fmt.Sprintf("%v ESMTP Service Ready", c.server.Domain))
+// greet sends the greeting to the client. It returns false if the backend
+// rejected the client, in which case the connection is closed.
+func (c *Conn) greet() bool {
+	banner := fmt.Sprintf("%v ESMTP Service Ready", c.server.Domain)
+	if cb, ok := c.server.Backend.(ConnectBackend); ok {
+		state := c.State()
+		text, err := cb.Connect(&state)
+		if err != nil {
+			if smtpErr, ok := err.(*SMTPError); ok {
+				c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			} else {
+				// Don't leak internal errors to clients
+				c.server.ErrorLog.Printf(c, "connection rejected for %v: %v", c.State().RemoteAddr, err)
+				c.WriteResponse(554, EnhancedCode{5, 7, 1}, "Connection rejected")
+			}
+			c.Close()
+			return false
+		}
+		if text != "" {
+			banner = text
+		}
+	}
+
+	c.WriteResponse(220, NoEnhancedCode, banner)
+	return true
 }
 
 func (c *Conn) WriteResponse(code int, enhCode EnhancedCode, text ...string) {
@@ -1018,6 +1652,50 @@ func (c *Conn) WriteResponse(code int, enhCode EnhancedCode, text ...string) {
 	}
 }
 
+// readCommand reads the next command line. The read is interrupted if the
+// server is shutting down.
+func (c *Conn) readCommand() (string, error) {
+	if t := c.server.ReadTimeout; t != 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(t)); err != nil {
+			return "", err
+		}
+	}
+
+	c.locker.Lock()
+	c.idle = true
+	c.locker.Unlock()
+
+	defer func() {
+		c.locker.Lock()
+		c.idle = false
+		c.locker.Unlock()
+	}()
+
+	if c.server.isShuttingDown() && !c.inTransfer() {
+		return "", errShuttingDown
+	}
+
+	return c.text.ReadLine()
+}
+
+// interruptIdle unblocks the connection if it is waiting for a command
+// outside of a message transfer.
+func (c *Conn) interruptIdle() {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if c.idle && c.bdatPipe == nil {
+		c.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// inTransfer reports whether a BDAT message transfer is in progress.
+func (c *Conn) inTransfer() bool {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.bdatPipe != nil
+}
+
 // Reads a line of input
 func (c *Conn) ReadLine() (string, error) {
 	if t := c.server.ReadTimeout; t != 0 {
@@ -1040,10 +1718,14 @@ func (c *Conn) reset() {
 	c.bdatStatus = nil
 	c.bytesReceived = 0
 
+	c.txCancel()
+	c.txCtx, c.txCancel = context.WithCancel(c.ctx)
+
 	if c.session != nil {
 		c.session.Reset()
 	}
 
 	c.fromReceived = false
 	c.recipients = nil
+	c.xforward = nil
 }
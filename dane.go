@@ -0,0 +1,237 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TLSA certificate usages, as defined in RFC 6698 section 2.1.1. Only
+// TLSAUsageDANETA and TLSAUsageDANEEE are used for SMTP (RFC 7672 section
+// 3.1).
+const (
+	TLSAUsagePKIXTA = 0
+	TLSAUsagePKIXEE = 1
+	TLSAUsageDANETA = 2
+	TLSAUsageDANEEE = 3
+)
+
+// TLSA selectors, as defined in RFC 6698 section 2.1.2.
+const (
+	TLSASelectorCert = 0
+	TLSASelectorSPKI = 1
+)
+
+// TLSA matching types, as defined in RFC 6698 section 2.1.3.
+const (
+	TLSAMatchingFull   = 0
+	TLSAMatchingSHA256 = 1
+	TLSAMatchingSHA512 = 2
+)
+
+// TLSA is a DNS TLSA resource record (RFC 6698).
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+func (r *TLSA) String() string {
+	return fmt.Sprintf("%d %d %d %x", r.Usage, r.Selector, r.MatchingType, r.Data)
+}
+
+// usable reports whether the record can be used to authenticate SMTP
+// servers.
+func (r *TLSA) usable() bool {
+	if r.Usage != TLSAUsageDANETA && r.Usage != TLSAUsageDANEEE {
+		return false
+	}
+	if r.Selector != TLSASelectorCert && r.Selector != TLSASelectorSPKI {
+		return false
+	}
+	switch r.MatchingType {
+	case TLSAMatchingFull, TLSAMatchingSHA256, TLSAMatchingSHA512:
+		return true
+	}
+	return false
+}
+
+// matches reports whether the record matches a certificate.
+func (r *TLSA) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch r.Selector {
+	case TLSASelectorCert:
+		data = cert.Raw
+	case TLSASelectorSPKI:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	switch r.MatchingType {
+	case TLSAMatchingFull:
+	case TLSAMatchingSHA256:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case TLSAMatchingSHA512:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, r.Data)
+}
+
+// TLSAResolver looks up TLSA records.
+type TLSAResolver interface {
+	// LookupTLSA returns the TLSA records of name, e.g.
+	// "_25._tcp.mx.example.org". secure reports whether the records have
+	// been validated with DNSSEC. If name has no TLSA records, no error is
+	// returned.
+	LookupTLSA(ctx context.Context, name string) (records []TLSA, secure bool, err error)
+}
+
+// DANE configures the verification of server certificates against TLSA
+// records, as defined in RFC 7672.
+//
+// If the server has TLSA records validated with DNSSEC, TLS is mandatory and
+// the certificate is verified against the records instead of the WebPKI:
+// DANE-EE records must match the server certificate, DANE-TA records must
+// match a certificate of the chain which is then used as trust anchor. If
+// none of the records is usable, TLS is still mandatory but the certificate
+// is verified as usual. A failed TLS handshake is reported as a *DANEError.
+// Without TLSA records, the certificate is verified as usual.
+type DANE struct {
+	// Resolver is used to look up TLSA records.
+	Resolver TLSAResolver
+	// Port used to look up TLSA records. If zero, 25 is used.
+	Port int
+}
+
+// lookup returns the usable TLSA records of host. It also reports whether
+// TLS is required: that's the case if host has TLSA records validated with
+// DNSSEC, even if none of them is usable (RFC 7672 section 2.2).
+func (d *DANE) lookup(ctx context.Context, host string) (usable []TLSA, required bool, err error) {
+	port := d.Port
+	if port == 0 {
+		port = 25
+	}
+	name := fmt.Sprintf("_%d._tcp.%s", port, strings.TrimSuffix(host, "."))
+
+	records, secure, err := d.Resolver.LookupTLSA(ctx, name)
+	if err != nil {
+		return nil, false, &DANEError{ServerName: host, Err: err}
+	}
+	if !secure || len(records) == 0 {
+		return nil, false, nil
+	}
+
+	for _, r := range records {
+		if r.usable() {
+			usable = append(usable, r)
+		}
+	}
+	return usable, true, nil
+}
+
+// DANEError is returned when a server can't be authenticated with DANE.
+// Clients must not fall back to cleartext after such an error.
+type DANEError struct {
+	ServerName string
+	Err        error
+}
+
+func (err *DANEError) Error() string {
+	return fmt.Sprintf("smtp: DANE authentication failed for %v: %v", err.ServerName, err.Err)
+}
+
+func (err *DANEError) Unwrap() error {
+	return err.Err
+}
+
+// daneHandshakeError converts a TLS handshake error into a *DANEError if DANE
+// requires TLS, so that callers don't fall back to cleartext.
+func daneHandshakeError(err error, serverName string, required bool) error {
+	if _, ok := err.(*DANEError); ok || !required {
+		return err
+	}
+	return &DANEError{ServerName: serverName, Err: err}
+}
+
+// setDANEVerification configures config to verify the server certificate
+// against TLSA records. onMatch is called with the matching record.
+func setDANEVerification(config *tls.Config, records []TLSA, onMatch func(r *TLSA)) {
+	config.InsecureSkipVerify = true
+	// Resumed sessions skip VerifyPeerCertificate
+	config.ClientSessionCache = nil
+	verifyPeerCertificate := config.VerifyPeerCertificate
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		certs, err := parseCertificates(rawCerts)
+		if err != nil {
+			return err
+		}
+		match, err := verifyDANE(certs, records, config)
+		if err != nil {
+			return &DANEError{ServerName: config.ServerName, Err: err}
+		}
+		onMatch(match)
+		if verifyPeerCertificate != nil {
+			return verifyPeerCertificate(rawCerts, chains)
+		}
+		return nil
+	}
+}
+
+// verifyDANE verifies the certificate chain sent by the server against TLSA
+// records, as described in RFC 7672 section 3.1.
+func verifyDANE(certs []*x509.Certificate, records []TLSA, config *tls.Config) (*TLSA, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("server didn't send any certificate")
+	}
+
+	var verifyErr error
+	for i := range records {
+		r := &records[i]
+		switch r.Usage {
+		case TLSAUsageDANEEE:
+			// The name and the validity period aren't checked
+			if r.matches(certs[0]) {
+				return r, nil
+			}
+		case TLSAUsageDANETA:
+			for _, anchor := range certs {
+				if !r.matches(anchor) {
+					continue
+				}
+				opts := x509.VerifyOptions{
+					Roots:         x509.NewCertPool(),
+					Intermediates: x509.NewCertPool(),
+					DNSName:       config.ServerName,
+				}
+				if config.Time != nil {
+					opts.CurrentTime = config.Time()
+				}
+				opts.Roots.AddCert(anchor)
+				for _, cert := range certs[1:] {
+					opts.Intermediates.AddCert(cert)
+				}
+				if _, err := certs[0].Verify(opts); err != nil {
+					verifyErr = err
+					continue
+				}
+				return r, nil
+			}
+		}
+	}
+	if verifyErr != nil {
+		return nil, verifyErr
+	}
+	return nil, errors.New("no TLSA record matches the certificate chain")
+}
@@ -0,0 +1,429 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+)
+
+// MXResolver performs the DNS lookups needed to deliver messages to a domain.
+// It is implemented by *net.Resolver.
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// A Deliverer sends messages directly to the mail exchangers of the
+// recipient domains, as described in RFC 5321 section 5.
+//
+// STARTTLS is used opportunistically: if the server doesn't support it or if
+// the TLS handshake fails, the message is sent in cleartext. Messages sent
+// with MailOptions.RequireTLS are only sent over TLS connections with a
+// verified certificate, to servers supporting REQUIRETLS (RFC 8689).
+//
+// If MTASTS is set and the recipient domain has a policy in enforce mode,
+// only the mail exchangers matching the policy are used and TLS with a
+// verified certificate is required (RFC 8461). DANE takes precedence over
+// MTA-STS for the mail exchangers publishing TLSA records.
+type Deliverer struct {
+	// Resolver is used to look up MX records. If nil, net.DefaultResolver is
+	// used.
+	Resolver MXResolver
+	// NetDialer is used to open the network connections. If nil, a
+	// net.Dialer with a default timeout is used.
+	NetDialer ContextDialer
+	// LocalName is the fully-qualified domain name sent with EHLO. If empty,
+	// "localhost" is used.
+	LocalName string
+	// TLSConfig is used for STARTTLS. Its ServerName is set to the name of
+	// the mail exchanger. Invalid certificates are only rejected for messages
+	// requiring TLS, since opportunistic TLS doesn't authenticate the server
+	// (RFC 7435).
+	TLSConfig *tls.Config
+	// DANE, if set, is used to authenticate mail exchangers publishing TLSA
+	// records (RFC 7672). Messages are never sent in cleartext to such
+	// servers.
+	DANE *DANE
+	// MTASTS, if set, is used to fetch the MTA-STS policies of recipient
+	// domains.
+	MTASTS *MTASTS
+}
+
+// DeliveryResult is the outcome of a delivery for a recipient.
+type DeliveryResult struct {
+	Addr string
+	// The mail exchanger which accepted or rejected the recipient, empty if
+	// none could be reached.
+	MX string
+	// The reason the delivery failed, nil if the message was accepted.
+	// Replies from the server are of type *SMTPError. Errors returned when
+	// the destination can't be found or reached are *SMTPError values too,
+	// unless a network error occurred.
+	Err error
+	// The TLS parameters of the connection to MX.
+	TLS TLSReport
+}
+
+// Temporary reports whether the delivery failed with a transient error and
+// should be retried later.
+func (r *DeliveryResult) Temporary() bool {
+	if r.Err == nil {
+		return false
+	}
+	if smtpErr, ok := r.Err.(*SMTPError); ok {
+		return smtpErr.Temporary()
+	}
+	return true
+}
+
+// Deliver sends a message to the recipients. Recipients of the same domain
+// are grouped in a single mail transaction.
+//
+// The mail exchangers of each domain are tried in order of preference. If
+// the domain has no MX records, its address records are used instead. The
+// next mail exchanger is tried if a connection can't be established or if
+// the server replies with a 4xx code before accepting recipients. 5xx
+// replies are final.
+//
+// The returned results are in the same order as rcpts. An error is returned
+// only if the message can't be read.
+func (d *Deliverer) Deliver(ctx context.Context, from string, opts *MailOptions, rcpts []Recipient, r io.Reader) ([]DeliveryResult, error) {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]DeliveryResult, len(rcpts))
+	var domains []string
+	groups := make(map[string][]int)
+	for i, rcpt := range rcpts {
+		results[i].Addr = rcpt.Addr
+		at := strings.LastIndexByte(rcpt.Addr, '@')
+		if at < 0 {
+			results[i].Err = &SMTPError{
+				Code:         553,
+				EnhancedCode: EnhancedCode{5, 1, 3},
+				Message:      "Recipient address has no domain",
+			}
+			continue
+		}
+		domain := strings.ToLower(rcpt.Addr[at+1:])
+		if _, ok := groups[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		groups[domain] = append(groups[domain], i)
+	}
+
+	for _, domain := range domains {
+		idx := groups[domain]
+		domainRcpts := make([]Recipient, len(idx))
+		for i, j := range idx {
+			domainRcpts[i] = rcpts[j]
+		}
+		domainResults := d.deliverDomain(ctx, domain, from, opts, domainRcpts, msg)
+		for i, j := range idx {
+			results[j] = domainResults[i]
+		}
+	}
+	return results, nil
+}
+
+func (d *Deliverer) deliverDomain(ctx context.Context, domain, from string, opts *MailOptions, rcpts []Recipient, msg []byte) []DeliveryResult {
+	results := make([]DeliveryResult, len(rcpts))
+	for i, rcpt := range rcpts {
+		results[i].Addr = rcpt.Addr
+	}
+
+	hosts, err := d.lookupMX(ctx, domain)
+	if err != nil {
+		for i := range results {
+			results[i].Err = err
+		}
+		return results
+	}
+
+	var enforceSTS bool
+	if d.MTASTS != nil && !strings.HasPrefix(domain, "[") {
+		hosts, enforceSTS, err = d.applySTS(ctx, domain, hosts)
+		if err != nil {
+			for i := range results {
+				results[i].Err = err
+			}
+			return results
+		}
+	}
+
+	var (
+		lastErr  error
+		lastHost string
+	)
+	requireTLS := opts != nil && opts.RequireTLS
+	for _, host := range hosts {
+		c, final, err := d.connect(ctx, host, requireTLS, enforceSTS)
+		if err != nil {
+			lastErr, lastHost = err, host
+			if final || ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		tlsReport := c.TLSReport()
+		var result *TransactionResult
+		err = c.withContext(ctx, func() error {
+			var err error
+			result, err = c.SendTransaction(from, opts, rcpts, bytes.NewReader(msg))
+			return err
+		})
+		if !isFatalError(err) {
+			c.withContext(ctx, c.Quit)
+		}
+		c.Close()
+
+		if result == nil {
+			// The transaction failed before the recipients were sent
+			lastErr, lastHost = err, host
+			if smtpErr, ok := err.(*SMTPError); ok && !smtpErr.Temporary() {
+				break
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		for i, rcptResult := range result.Recipients {
+			results[i].MX = host
+			results[i].TLS = tlsReport
+			if rcptResult.Err != nil {
+				results[i].Err = rcptResult.Err
+			} else if err != nil {
+				results[i].Err = err
+			}
+		}
+		return results
+	}
+
+	for i := range results {
+		results[i].MX = lastHost
+		results[i].Err = lastErr
+	}
+	return results
+}
+
+// lookupMX returns the mail exchangers of a domain, in order of preference.
+func (d *Deliverer) lookupMX(ctx context.Context, domain string) ([]string, error) {
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		// Address literal
+		ip := strings.TrimPrefix(domain[1:len(domain)-1], "IPv6:")
+		if net.ParseIP(ip) == nil {
+			return nil, &SMTPError{
+				Code:         553,
+				EnhancedCode: EnhancedCode{5, 1, 3},
+				Message:      "Invalid address literal",
+			}
+		}
+		return []string{ip}, nil
+	}
+
+	var r MXResolver = net.DefaultResolver
+	if d.Resolver != nil {
+		r = d.Resolver
+	}
+
+	records, err := r.LookupMX(ctx, domain)
+	if err != nil && !isDNSNotFound(err) {
+		return nil, dnsLookupError(domain, err)
+	}
+
+	if len(records) == 1 && records[0].Host == "." {
+		return nil, &SMTPError{
+			Code:         556,
+			EnhancedCode: EnhancedCode{5, 1, 10},
+			Message:      fmt.Sprintf("Domain %v does not accept mail", domain),
+		}
+	}
+
+	if len(records) == 0 {
+		// Implicit MX (RFC 5321 section 5.1)
+		addrs, err := r.LookupIPAddr(ctx, domain)
+		if err != nil && !isDNSNotFound(err) {
+			return nil, dnsLookupError(domain, err)
+		}
+		if len(addrs) == 0 {
+			return nil, &SMTPError{
+				Code:         550,
+				EnhancedCode: EnhancedCode{5, 1, 2},
+				Message:      fmt.Sprintf("Domain %v not found", domain),
+			}
+		}
+		return []string{domain}, nil
+	}
+
+	records = append([]*net.MX(nil), records...)
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+	hosts := make([]string, 0, len(records))
+	for _, mx := range records {
+		if host := strings.TrimSuffix(mx.Host, "."); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, &SMTPError{
+			Code:         550,
+			EnhancedCode: EnhancedCode{5, 4, 4},
+			Message:      fmt.Sprintf("No valid mail exchanger for domain %v", domain),
+		}
+	}
+	return hosts, nil
+}
+
+// applySTS filters the mail exchangers of a domain according to its MTA-STS
+// policy. It reports whether the policy is enforced.
+func (d *Deliverer) applySTS(ctx context.Context, domain string, hosts []string) ([]string, bool, error) {
+	policy, err := d.MTASTS.Policy(ctx, domain)
+	if err != nil || policy == nil || policy.Mode != STSModeEnforce {
+		// Without a valid policy, messages are delivered as usual
+		return hosts, false, nil
+	}
+
+	var matching []string
+	for _, host := range hosts {
+		if policy.Match(host) {
+			matching = append(matching, host)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, false, stsError(fmt.Sprintf("no mail exchanger of %v matches the policy", domain))
+	}
+	return matching, true, nil
+}
+
+// connect opens a connection to a mail exchanger and starts TLS. If neither
+// requireTLS nor enforceSTS is set, TLS is opportunistic. It reports whether
+// the error is a 5xx reply of the server, in which case the other mail
+// exchangers must not be tried.
+func (d *Deliverer) connect(ctx context.Context, host string, requireTLS, enforceSTS bool) (c *Client, final bool, err error) {
+	policy := TLSPolicyOpportunistic
+	if requireTLS || enforceSTS {
+		policy = TLSPolicyRequired
+	}
+	c, err = d.dial(ctx, host, policy)
+	if err != nil {
+		return nil, isPermanentReply(err), err
+	}
+
+	err = c.HelloContext(ctx, d.localName())
+	if err != nil && policy == TLSPolicyOpportunistic {
+		c.Close()
+		if _, ok := err.(*SMTPError); ok || ctx.Err() != nil {
+			return nil, isPermanentReply(err), err
+		}
+		// DANE requires TLS, handshake failures included
+		if _, ok := err.(*DANEError); ok {
+			return nil, false, err
+		}
+		// The TLS handshake failed, try again without TLS
+		if c, err = d.dial(ctx, host, TLSPolicyNone); err != nil {
+			return nil, isPermanentReply(err), err
+		}
+		err = c.HelloContext(ctx, d.localName())
+	}
+	if err != nil {
+		c.Close()
+		if _, ok := err.(*SMTPError); !ok && ctx.Err() == nil {
+			if requireTLS {
+				return nil, false, requireTLSError(err.Error())
+			} else if enforceSTS {
+				return nil, false, stsError(err.Error())
+			}
+		}
+		return nil, isPermanentReply(err), err
+	}
+
+	if report := c.TLSReport(); !report.Verified && policy == TLSPolicyRequired {
+		c.Close()
+		if requireTLS {
+			return nil, false, requireTLSError("certificate not verified")
+		}
+		return nil, false, stsError("certificate not verified")
+	}
+	if requireTLS {
+		if ok, _ := c.Extension("REQUIRETLS"); !ok {
+			c.Close()
+			return nil, false, requireTLSError("server doesn't support REQUIRETLS")
+		}
+	}
+	return c, false, nil
+}
+
+func (d *Deliverer) dial(ctx context.Context, host string, policy TLSPolicy) (*Client, error) {
+	dialer := Dialer{
+		NetDialer: d.NetDialer,
+		TLSPolicy: policy,
+		TLSConfig: d.tlsConfig(host),
+		DANE:      d.DANE,
+	}
+	return dialer.DialContext(ctx, net.JoinHostPort(host, "25"))
+}
+
+func (d *Deliverer) localName() string {
+	if d.LocalName == "" {
+		return "localhost"
+	}
+	return d.LocalName
+}
+
+func (d *Deliverer) tlsConfig(host string) *tls.Config {
+	var config *tls.Config
+	if d.TLSConfig == nil {
+		config = &tls.Config{}
+	} else {
+		config = d.TLSConfig.Clone()
+	}
+	config.ServerName = host
+	return config
+}
+
+func requireTLSError(reason string) *SMTPError {
+	return &SMTPError{
+		Code:         550,
+		EnhancedCode: EnhancedCode{5, 7, 10},
+		Message:      "REQUIRETLS support required: " + reason,
+	}
+}
+
+func stsError(reason string) *SMTPError {
+	return &SMTPError{
+		Code:         451,
+		EnhancedCode: EnhancedCode{4, 7, 5},
+		Message:      "MTA-STS policy failure: " + reason,
+	}
+}
+
+// isPermanentReply reports whether err is a 5xx reply of the server.
+func isPermanentReply(err error) bool {
+	smtpErr, ok := err.(*SMTPError)
+	return ok && !smtpErr.Temporary()
+}
+
+func isDNSNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func dnsLookupError(domain string, err error) *SMTPError {
+	return &SMTPError{
+		Code:         451,
+		EnhancedCode: EnhancedCode{4, 4, 3},
+		Message:      fmt.Sprintf("DNS lookup failed for domain %v: %v", domain, err),
+	}
+}
@@ -0,0 +1,383 @@
+package smtp_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+type mxResolver struct {
+	mx    map[string][]*net.MX
+	addrs map[string][]net.IPAddr
+}
+
+func (r *mxResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if name == "broken.example" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	records, ok := r.mx[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func (r *mxResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// hostDialer connects to local listeners instead of the requested hosts.
+type hostDialer map[string]string
+
+func (d hostDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	localAddr, ok := d[host]
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+	var netDialer net.Dialer
+	return netDialer.DialContext(ctx, network, localAddr)
+}
+
+func testDeliveryServer(t *testing.T) (*backend, *smtp.Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be := new(backend)
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	go s.Serve(l)
+	return be, s, l.Addr().String()
+}
+
+func TestDeliverer(t *testing.T) {
+	beOrg, sOrg, addrOrg := testDeliveryServer(t)
+	defer sOrg.Close()
+	beNet, sNet, addrNet := testDeliveryServer(t)
+	defer sNet.Close()
+
+	d := &smtp.Deliverer{
+		Resolver: &mxResolver{
+			mx: map[string][]*net.MX{
+				"example.org": {
+					{Host: "mx2.example.org.", Pref: 20},
+					{Host: "mx1.example.org.", Pref: 10},
+				},
+				"example.com": {{Host: ".", Pref: 0}},
+			},
+			addrs: map[string][]net.IPAddr{
+				"example.net": {{IP: net.ParseIP("192.0.2.1")}},
+			},
+		},
+		NetDialer: hostDialer{
+			"mx2.example.org": addrOrg,
+			"example.net":     addrNet,
+		},
+		LocalName: "mx.example.edu",
+	}
+
+	rcpts := []smtp.Recipient{
+		{Addr: "alice@example.org"},
+		{Addr: "carol@example.net"},
+		{Addr: "bob@EXAMPLE.org"},
+		{Addr: "dave@example.com"},
+		{Addr: "eve@nowhere.example"},
+		{Addr: "mallory@broken.example"},
+		{Addr: "trent"},
+	}
+	results, err := d.Deliver(context.Background(), "root@example.edu", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+
+	want := []struct {
+		mx   string
+		code int
+	}{
+		{"mx2.example.org", 0},
+		{"example.net", 0},
+		{"mx2.example.org", 0},
+		{"", 556},
+		{"", 550},
+		{"", 451},
+		{"", 553},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("Deliver returned %v results; want %v", len(results), len(want))
+	}
+	for i, res := range results {
+		if res.Addr != rcpts[i].Addr {
+			t.Errorf("Result #%v has address %q; want %q", i, res.Addr, rcpts[i].Addr)
+		}
+		if res.MX != want[i].mx {
+			t.Errorf("Result #%v has MX %q; want %q", i, res.MX, want[i].mx)
+		}
+		if want[i].code == 0 {
+			if res.Err != nil {
+				t.Errorf("Result #%v has error %v; want nil", i, res.Err)
+			}
+			continue
+		}
+		if smtpErr, ok := res.Err.(*smtp.SMTPError); !ok || smtpErr.Code != want[i].code {
+			t.Errorf("Result #%v has error %v; want code %v", i, res.Err, want[i].code)
+		}
+	}
+	if !results[5].Temporary() || results[4].Temporary() {
+		t.Error("Invalid temporary status of DNS errors")
+	}
+
+	if len(beOrg.anonmsgs) != 1 {
+		t.Fatal("Invalid number of messages sent to example.org:", len(beOrg.anonmsgs))
+	}
+	if to := beOrg.anonmsgs[0].To; len(to) != 2 || to[0] != "alice@example.org" || to[1] != "bob@EXAMPLE.org" {
+		t.Fatal("Invalid recipients sent to example.org:", to)
+	}
+	if len(beNet.anonmsgs) != 1 {
+		t.Fatal("Invalid number of messages sent to example.net:", len(beNet.anonmsgs))
+	}
+}
+
+func TestDeliverer_Fallback(t *testing.T) {
+	be1, s1, addr1 := testDeliveryServer(t)
+	defer s1.Close()
+	be2, s2, addr2 := testDeliveryServer(t)
+	defer s2.Close()
+
+	d := &smtp.Deliverer{
+		Resolver: &mxResolver{
+			mx: map[string][]*net.MX{
+				"example.org": {
+					{Host: "mx1.example.org.", Pref: 10},
+					{Host: "mx2.example.org.", Pref: 20},
+				},
+			},
+		},
+		NetDialer: hostDialer{
+			"mx1.example.org": addr1,
+			"mx2.example.org": addr2,
+		},
+	}
+	rcpts := []smtp.Recipient{{Addr: "alice@example.org"}}
+
+	// 4xx replies cause the next mail exchanger to be tried
+	be1.userErr = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Try again later",
+	}
+	results, err := d.Deliver(context.Background(), "root@example.edu", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	if res := results[0]; res.Err != nil || res.MX != "mx2.example.org" {
+		t.Fatalf("Deliver returned %+v; want delivery to mx2.example.org", res)
+	}
+	if len(be2.anonmsgs) != 1 {
+		t.Fatal("Invalid number of messages sent to mx2:", len(be2.anonmsgs))
+	}
+
+	// 5xx replies are final
+	be1.userErr = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Go away",
+	}
+	results, err = d.Deliver(context.Background(), "root@example.edu", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	res := results[0]
+	if smtpErr, ok := res.Err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 || res.MX != "mx1.example.org" {
+		t.Fatalf("Deliver returned %+v; want 550 error from mx1.example.org", res)
+	}
+	if res.Temporary() {
+		t.Error("Expected a permanent failure")
+	}
+	if len(be2.anonmsgs) != 1 {
+		t.Fatal("Invalid number of messages sent to mx2:", len(be2.anonmsgs))
+	}
+	be1.userErr = nil
+
+	// So are 5xx replies to the greeting and to EHLO, while 4xx replies
+	// cause the next mail exchanger to be tried
+	rejectGreeting := func(code int) {
+		be1.connectErr = &smtp.SMTPError{
+			Code:         code,
+			EnhancedCode: smtp.EnhancedCode{code / 100, 7, 1},
+			Message:      "Client host rejected",
+		}
+	}
+	rejectEHLO := func(code int) {
+		be1.hello = func(domain string, caps []string) ([]string, error) {
+			return nil, &smtp.SMTPError{
+				Code:         code,
+				EnhancedCode: smtp.EnhancedCode{code / 100, 7, 1},
+				Message:      "Go away",
+			}
+		}
+	}
+	tests := []struct {
+		name   string
+		reject func(code int)
+		code   int
+		mx     string
+	}{
+		{"5xx greeting", rejectGreeting, 554, "mx1.example.org"},
+		{"4xx greeting", rejectGreeting, 421, "mx2.example.org"},
+		{"5xx EHLO", rejectEHLO, 550, "mx1.example.org"},
+		{"4xx EHLO", rejectEHLO, 450, "mx2.example.org"},
+	}
+	for _, test := range tests {
+		be1.connectErr = nil
+		be1.hello = nil
+		test.reject(test.code)
+		sent := len(be2.anonmsgs)
+
+		results, err = d.Deliver(context.Background(), "root@example.edu", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+		if err != nil {
+			t.Fatalf("%v: Deliver: %v", test.name, err)
+		}
+		res := results[0]
+		if res.MX != test.mx {
+			t.Errorf("%v: Deliver returned %+v; want %v", test.name, res, test.mx)
+		}
+		if test.code/100 == 5 {
+			if smtpErr, ok := res.Err.(*smtp.SMTPError); !ok || smtpErr.Code != test.code {
+				t.Errorf("%v: Deliver returned %+v; want %v error", test.name, res, test.code)
+			}
+			if len(be2.anonmsgs) != sent {
+				t.Errorf("%v: message sent to mx2", test.name)
+			}
+		} else if res.Err != nil || len(be2.anonmsgs) != sent+1 {
+			t.Errorf("%v: Deliver returned %+v; want delivery to mx2", test.name, res)
+		}
+	}
+}
+
+func TestDeliverer_RequireTLS(t *testing.T) {
+	be, s, addr := testDeliveryServer(t)
+	defer s.Close()
+
+	d := &smtp.Deliverer{
+		Resolver: &mxResolver{
+			mx: map[string][]*net.MX{
+				"example.org": {{Host: "mx.example.org.", Pref: 10}},
+			},
+		},
+		NetDialer: hostDialer{"mx.example.org": addr},
+	}
+	rcpts := []smtp.Recipient{{Addr: "alice@example.org"}}
+	opts := &smtp.MailOptions{RequireTLS: true}
+	results, err := d.Deliver(context.Background(), "root@example.edu", opts, rcpts, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	res := results[0]
+	if smtpErr, ok := res.Err.(*smtp.SMTPError); !ok || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 10}) {
+		t.Fatalf("Deliver returned %+v; want 5.7.10 error", res)
+	}
+	if len(be.anonmsgs) != 0 {
+		t.Fatal("Message sent without TLS")
+	}
+}
+
+type tlsaResolver []smtp.TLSA
+
+func (r tlsaResolver) LookupTLSA(ctx context.Context, name string) ([]smtp.TLSA, bool, error) {
+	return r, true, nil
+}
+
+func TestDeliverer_DANE(t *testing.T) {
+	cert, _ := testCertificate(t)
+	spki := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	match := smtp.TLSA{
+		Usage:        smtp.TLSAUsageDANEEE,
+		Selector:     smtp.TLSASelectorSPKI,
+		MatchingType: smtp.TLSAMatchingSHA256,
+		Data:         spki[:],
+	}
+	mismatch := match
+	mismatch.Data = make([]byte, 32)
+	unusable := match
+	unusable.Usage = smtp.TLSAUsagePKIXEE
+
+	tests := []struct {
+		name      string
+		record    smtp.TLSA
+		tls       bool // server offers STARTTLS
+		handshake bool // TLS handshake succeeds
+		delivered bool
+	}{
+		{name: "no STARTTLS", record: match},
+		{name: "match", record: match, tls: true, handshake: true, delivered: true},
+		{name: "mismatch", record: mismatch, tls: true, handshake: true},
+		{name: "handshake failure", record: match, tls: true},
+		{name: "unusable, no STARTTLS", record: unusable},
+		{name: "unusable", record: unusable, tls: true, handshake: true, delivered: true},
+		{name: "unusable, handshake failure", record: unusable, tls: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			be, s, addr := testDeliveryServer(t)
+			defer s.Close()
+			if tc.tls {
+				s.TLSConfig = &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					MinVersion:   tls.VersionTLS13,
+				}
+			}
+
+			d := &smtp.Deliverer{
+				Resolver: &mxResolver{
+					mx: map[string][]*net.MX{
+						"example.org": {{Host: "mx.example.org.", Pref: 10}},
+					},
+				},
+				NetDialer: hostDialer{"mx.example.org": addr},
+				DANE:      &smtp.DANE{Resolver: tlsaResolver{tc.record}},
+			}
+			if !tc.handshake {
+				d.TLSConfig = &tls.Config{MaxVersion: tls.VersionTLS12}
+			}
+
+			rcpts := []smtp.Recipient{{Addr: "alice@example.org"}}
+			results, err := d.Deliver(context.Background(), "root@example.edu", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+			if err != nil {
+				t.Fatalf("Deliver: %v", err)
+			}
+			res := results[0]
+			if tc.delivered {
+				if res.Err != nil {
+					t.Fatalf("Deliver returned %+v; want success", res)
+				}
+				if !res.TLS.Encrypted {
+					t.Error("Message sent without TLS")
+				}
+				return
+			}
+
+			if res.Err == nil || !res.Temporary() {
+				t.Fatalf("Deliver returned %+v; want a temporary DANE failure", res)
+			}
+			var daneErr *smtp.DANEError
+			if tc.tls && !errors.As(res.Err, &daneErr) {
+				t.Errorf("Deliver returned %v; want a DANE error", res.Err)
+			}
+			if len(be.anonmsgs) != 0 {
+				t.Fatal("Message sent without TLS to a server with TLSA records")
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// STSMode is the mode of an MTA-STS policy.
+type STSMode string
+
+const (
+	// Deliveries to mail exchangers which don't match the policy or don't
+	// have a valid certificate fail.
+	STSModeEnforce STSMode = "enforce"
+	// Policy failures are reported but deliveries proceed as usual.
+	STSModeTesting STSMode = "testing"
+	// The domain has no active policy.
+	STSModeNone STSMode = "none"
+)
+
+// maxSTSPolicySize is the maximum size of a policy file.
+const maxSTSPolicySize = 64 * 1024
+
+// STSPolicy is an MTA-STS policy, as defined in RFC 8461 section 3.2.
+type STSPolicy struct {
+	Mode STSMode
+	// Patterns of the mail exchangers of the domain. A pattern may start
+	// with "*." to match any host in a sub-domain.
+	MX     []string
+	MaxAge time.Duration
+}
+
+// ParseSTSPolicy parses a policy file.
+func ParseSTSPolicy(r io.Reader) (*STSPolicy, error) {
+	var (
+		policy     STSPolicy
+		version    string
+		haveMaxAge bool
+	)
+	s := bufio.NewScanner(io.LimitReader(r, maxSTSPolicySize))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("smtp: malformed MTA-STS policy line: %q", line)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if version == "" && key != "version" {
+			return nil, errors.New("smtp: MTA-STS policy doesn't start with a version")
+		}
+
+		switch key {
+		case "version":
+			if value != "STSv1" {
+				return nil, fmt.Errorf("smtp: unsupported MTA-STS policy version: %q", value)
+			}
+			version = value
+		case "mode":
+			switch mode := STSMode(value); mode {
+			case STSModeEnforce, STSModeTesting, STSModeNone:
+				policy.Mode = mode
+			default:
+				return nil, fmt.Errorf("smtp: invalid MTA-STS policy mode: %q", value)
+			}
+		case "mx":
+			policy.MX = append(policy.MX, strings.ToLower(strings.TrimSuffix(value, ".")))
+		case "max_age":
+			// The maximum value is 31557600 (RFC 8461 section 3.2)
+			secs, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || secs > 31557600 {
+				return nil, fmt.Errorf("smtp: invalid MTA-STS policy max_age: %q", value)
+			}
+			policy.MaxAge = time.Duration(secs) * time.Second
+			haveMaxAge = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if version == "" {
+		return nil, errors.New("smtp: empty MTA-STS policy")
+	}
+	if policy.Mode == "" || !haveMaxAge {
+		return nil, errors.New("smtp: MTA-STS policy is missing mode or max_age")
+	}
+	if policy.Mode != STSModeNone && len(policy.MX) == 0 {
+		return nil, errors.New("smtp: MTA-STS policy has no mx")
+	}
+	return &policy, nil
+}
+
+// Match checks whether a mail exchanger matches the policy.
+func (p *STSPolicy) Match(mx string) bool {
+	mx = strings.ToLower(strings.TrimSuffix(mx, "."))
+	for _, pattern := range p.MX {
+		if strings.HasPrefix(pattern, "*.") {
+			// The wildcard only matches the left-most label
+			i := strings.IndexByte(mx, '.')
+			if i > 0 && mx[i:] == pattern[1:] {
+				return true
+			}
+		} else if mx == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// TXTResolver looks up DNS TXT records. It is implemented by *net.Resolver.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// MTASTS fetches the MTA-STS policies of domains, as described in RFC 8461
+// section 3.
+//
+// The policy is fetched again when the ID of the domain's TXT record changes.
+// If the policy can't be fetched, the previous one is used until it expires.
+type MTASTS struct {
+	// Resolver is used to look up the TXT records. If nil,
+	// net.DefaultResolver is used.
+	Resolver TXTResolver
+	// HTTPClient is used to fetch the policies. If nil, http.DefaultClient is
+	// used. Redirects are never followed.
+	HTTPClient *http.Client
+	// CacheDir is the directory where the policies are cached. If empty,
+	// policies aren't cached.
+	CacheDir string
+}
+
+type stsCacheEntry struct {
+	ID      string
+	Fetched time.Time
+	Policy  *STSPolicy
+}
+
+func (e *stsCacheEntry) expired() bool {
+	return time.Now().After(e.Fetched.Add(e.Policy.MaxAge))
+}
+
+// Policy returns the policy of a domain. It returns nil if the domain has no
+// policy.
+func (m *MTASTS) Policy(ctx context.Context, domain string) (*STSPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if !isSTSDomain(domain) {
+		return nil, nil
+	}
+
+	cached := m.readCache(domain)
+
+	id, err := m.lookupID(ctx, domain)
+	if err == nil && id != "" && (cached == nil || cached.ID != id) {
+		var policy *STSPolicy
+		policy, err = m.fetch(ctx, domain)
+		if err == nil {
+			// A failure to write the cache only causes the policy to be
+			// fetched again
+			m.writeCache(domain, &stsCacheEntry{
+				ID:      id,
+				Fetched: time.Now(),
+				Policy:  policy,
+			})
+			return policy, nil
+		}
+	}
+
+	if cached != nil {
+		return cached.Policy, nil
+	}
+	return nil, err
+}
+
+// lookupID returns the policy ID of a domain, or an empty string if the
+// domain has no valid TXT record.
+func (m *MTASTS) lookupID(ctx context.Context, domain string) (string, error) {
+	var r TXTResolver = net.DefaultResolver
+	if m.Resolver != nil {
+		r = m.Resolver
+	}
+
+	records, err := r.LookupTXT(ctx, "_mta-sts."+domain)
+	if isDNSNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("smtp: failed to look up MTA-STS record for %v: %v", domain, err)
+	}
+
+	var id string
+	n := 0
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=STSv1;") && record != "v=STSv1" {
+			continue
+		}
+		n++
+		id = ""
+		for _, field := range strings.Split(record, ";") {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "id=") {
+				id = strings.TrimPrefix(field, "id=")
+			}
+		}
+	}
+	// Domains with several records have no policy (RFC 8461 section 3.1)
+	if n != 1 || !isSTSID(id) {
+		return "", nil
+	}
+	return id, nil
+}
+
+func (m *MTASTS) fetch(ctx context.Context, domain string) (*STSPolicy, error) {
+	client := http.DefaultClient
+	if m.HTTPClient != nil {
+		client = m.HTTPClient
+	}
+	noRedirect := *client
+	noRedirect.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := noRedirect.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: failed to fetch MTA-STS policy for %v: %v", domain, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("smtp: failed to fetch MTA-STS policy for %v: %v", domain, resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/plain" {
+		return nil, fmt.Errorf("smtp: MTA-STS policy for %v has invalid media type %q", domain, mediaType)
+	}
+	return ParseSTSPolicy(resp.Body)
+}
+
+// readCache returns the cached policy of a domain, or nil if there is no
+// valid cached policy.
+func (m *MTASTS) readCache(domain string) *stsCacheEntry {
+	if m.CacheDir == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(m.cachePath(domain))
+	if err != nil {
+		return nil
+	}
+	var entry stsCacheEntry
+	if err := json.Unmarshal(b, &entry); err != nil || entry.Policy == nil || entry.expired() {
+		return nil
+	}
+	return &entry
+}
+
+func (m *MTASTS) writeCache(domain string, entry *stsCacheEntry) error {
+	if m.CacheDir == "" {
+		return nil
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(m.CacheDir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), m.cachePath(domain))
+}
+
+func (m *MTASTS) cachePath(domain string) string {
+	return filepath.Join(m.CacheDir, domain+".json")
+}
+
+// isSTSDomain checks whether a domain can have a policy. This also ensures
+// the domain can be used as a cache file name.
+func isSTSDomain(domain string) bool {
+	if domain == "" || domain[0] == '.' || strings.Contains(domain, "..") {
+		return false
+	}
+	for _, ch := range domain {
+		if !(ch >= 'a' && ch <= 'z') && !(ch >= '0' && ch <= '9') && ch != '-' && ch != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isSTSID(id string) bool {
+	if id == "" || len(id) > 32 {
+		return false
+	}
+	for _, ch := range id {
+		if !(ch >= 'a' && ch <= 'z') && !(ch >= 'A' && ch <= 'Z') && !(ch >= '0' && ch <= '9') {
+			return false
+		}
+	}
+	return true
+}
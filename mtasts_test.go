@@ -0,0 +1,276 @@
+package smtp_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestParseSTSPolicy(t *testing.T) {
+	valid := "version: STSv1\r\n" +
+		"mode: enforce\r\n" +
+		"mx: mail.example.com\r\n" +
+		"mx: *.example.net\n" +
+		"mx: backupmx.example.com.\r\n" +
+		"max_age: 604800\r\n"
+	policy, err := smtp.ParseSTSPolicy(strings.NewReader(valid))
+	if err != nil {
+		t.Fatalf("ParseSTSPolicy: %v", err)
+	}
+	if policy.Mode != smtp.STSModeEnforce || policy.MaxAge != 7*24*time.Hour || len(policy.MX) != 3 {
+		t.Errorf("Invalid policy: %+v", policy)
+	}
+
+	matches := map[string]bool{
+		"mail.example.com":     true,
+		"MAIL.example.com.":    true,
+		"mx1.example.net":      true,
+		"backupmx.example.com": true,
+		"example.net":          false,
+		"a.mx1.example.net":    false,
+		"mail.example.org":     false,
+	}
+	for mx, want := range matches {
+		if got := policy.Match(mx); got != want {
+			t.Errorf("Match(%q) = %v; want %v", mx, got, want)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"mode: enforce\nversion: STSv1\nmx: mail.example.com\nmax_age: 86400\n",
+		"version: STSv2\nmode: enforce\nmx: mail.example.com\nmax_age: 86400\n",
+		"version: STSv1\nmode: strict\nmx: mail.example.com\nmax_age: 86400\n",
+		"version: STSv1\nmode: enforce\nmax_age: 86400\n",
+		"version: STSv1\nmode: enforce\nmx: mail.example.com\n",
+		"version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: 31557601\n",
+	}
+	for _, s := range invalid {
+		if _, err := smtp.ParseSTSPolicy(strings.NewReader(s)); err == nil {
+			t.Errorf("ParseSTSPolicy(%q) succeeded", s)
+		}
+	}
+
+	policy, err = smtp.ParseSTSPolicy(strings.NewReader("version: STSv1\nmode: none\nmax_age: 86400\n"))
+	if err != nil || policy.Mode != smtp.STSModeNone {
+		t.Errorf("ParseSTSPolicy returned %+v, %v; want a policy in none mode", policy, err)
+	}
+}
+
+type txtResolver struct {
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func (r *txtResolver) set(name string, records ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records[name] = records
+}
+
+func (r *txtResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	records, ok := r.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+// stsServer serves MTA-STS policies over HTTPS.
+type stsServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	policy  string
+	fetches int
+}
+
+func newSTSServer(policy string) *stsServer {
+	s := &stsServer{policy: policy}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+		if req.Host != "mta-sts.example.com" || req.URL.Path != "/.well-known/mta-sts.txt" || s.policy == "" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(s.policy))
+	}))
+	return s
+}
+
+func (s *stsServer) set(policy string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = policy
+}
+
+func (s *stsServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+// client returns an HTTP client connecting to the server for any host.
+func (s *stsServer) client() *http.Client {
+	client := s.Client()
+	addr := s.Listener.Addr().String()
+	client.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var netDialer net.Dialer
+		return netDialer.DialContext(ctx, network, addr)
+	}
+	return client
+}
+
+const testSTSPolicy = "version: STSv1\r\n" +
+	"mode: enforce\r\n" +
+	"mx: mx1.example.com\r\n" +
+	"max_age: 86400\r\n"
+
+func TestMTASTS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-mta-sts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newSTSServer(testSTSPolicy)
+	defer s.Close()
+
+	resolver := &txtResolver{records: map[string][]string{
+		"_mta-sts.example.com": {"v=STSv1; id=20160831085700Z;"},
+		"_mta-sts.example.org": {"v=STSv1; id=1", "v=STSv1; id=2"},
+	}}
+	m := &smtp.MTASTS{
+		Resolver:   resolver,
+		HTTPClient: s.client(),
+		CacheDir:   dir,
+	}
+
+	policy, err := m.Policy(context.Background(), "EXAMPLE.com")
+	if err != nil {
+		t.Fatalf("Policy: %v", err)
+	}
+	if policy == nil || policy.Mode != smtp.STSModeEnforce || !policy.Match("mx1.example.com") {
+		t.Fatalf("Invalid policy: %+v", policy)
+	}
+
+	// The cached policy is used while the ID doesn't change, even after a
+	// restart
+	m = &smtp.MTASTS{
+		Resolver:   resolver,
+		HTTPClient: s.client(),
+		CacheDir:   dir,
+	}
+	if policy, err := m.Policy(context.Background(), "example.com"); err != nil || policy == nil {
+		t.Fatalf("Policy returned %+v, %v; want cached policy", policy, err)
+	}
+	if n := s.count(); n != 1 {
+		t.Fatalf("Policy fetched %v times; want once", n)
+	}
+
+	// A new ID causes the policy to be fetched again
+	s.set("version: STSv1\r\nmode: testing\r\nmx: *.example.com\r\nmax_age: 86400\r\n")
+	resolver.set("_mta-sts.example.com", "v=STSv1; id=2")
+	policy, err = m.Policy(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("Policy: %v", err)
+	}
+	if policy.Mode != smtp.STSModeTesting || s.count() != 2 {
+		t.Fatalf("Policy returned %+v after %v fetches; want updated policy", policy, s.count())
+	}
+
+	// If the policy can't be fetched, the cached one is used
+	s.set("")
+	resolver.set("_mta-sts.example.com", "v=STSv1; id=3")
+	policy, err = m.Policy(context.Background(), "example.com")
+	if err != nil || policy == nil || policy.Mode != smtp.STSModeTesting {
+		t.Fatalf("Policy returned %+v, %v; want cached policy", policy, err)
+	}
+
+	// Without a cached policy, fetch failures are returned
+	m.CacheDir = ""
+	if policy, err := m.Policy(context.Background(), "example.com"); err == nil {
+		t.Fatalf("Policy returned %+v; want an error", policy)
+	}
+
+	// Domains without a single valid record have no policy
+	for _, domain := range []string{"example.net", "example.org", "../example.com"} {
+		if policy, err := m.Policy(context.Background(), domain); err != nil || policy != nil {
+			t.Errorf("Policy(%q) returned %+v, %v; want no policy", domain, policy, err)
+		}
+	}
+}
+
+func TestDeliverer_MTASTS(t *testing.T) {
+	s := newSTSServer(testSTSPolicy)
+	defer s.Close()
+
+	be1, s1, addr1 := testDeliveryServer(t)
+	defer s1.Close()
+	be2, s2, addr2 := testDeliveryServer(t)
+	defer s2.Close()
+
+	resolver := &txtResolver{records: map[string][]string{
+		"_mta-sts.example.com": {"v=STSv1; id=1"},
+	}}
+	d := &smtp.Deliverer{
+		Resolver: &mxResolver{
+			mx: map[string][]*net.MX{
+				"example.com": {
+					{Host: "mx1.example.com.", Pref: 10},
+					{Host: "mx2.example.org.", Pref: 20},
+				},
+			},
+		},
+		NetDialer: hostDialer{
+			"mx1.example.com": addr1,
+			"mx2.example.org": addr2,
+		},
+		MTASTS: &smtp.MTASTS{
+			Resolver:   resolver,
+			HTTPClient: s.client(),
+		},
+	}
+	rcpts := []smtp.Recipient{{Addr: "alice@example.com"}}
+
+	// mx1 doesn't support TLS and mx2 doesn't match the policy
+	results, err := d.Deliver(context.Background(), "root@example.edu", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	res := results[0]
+	if smtpErr, ok := res.Err.(*smtp.SMTPError); !ok || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 7, 5}) || res.MX != "mx1.example.com" {
+		t.Fatalf("Deliver returned %+v; want 4.7.5 error from mx1.example.com", res)
+	}
+	if len(be1.anonmsgs) != 0 || len(be2.anonmsgs) != 0 {
+		t.Fatal("Message sent in violation of the MTA-STS policy")
+	}
+
+	// Policies in testing mode aren't enforced
+	s.set(strings.Replace(testSTSPolicy, "enforce", "testing", 1))
+	resolver.set("_mta-sts.example.com", "v=STSv1; id=2")
+	results, err = d.Deliver(context.Background(), "root@example.edu", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	if res := results[0]; res.Err != nil || res.MX != "mx1.example.com" {
+		t.Fatalf("Deliver returned %+v; want delivery to mx1.example.com", res)
+	}
+	if len(be1.anonmsgs) != 1 {
+		t.Fatal("Invalid number of messages sent to mx1:", len(be1.anonmsgs))
+	}
+}
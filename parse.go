@@ -16,22 +16,19 @@ func parseCmd(line string) (cmd string, arg string, err error) {
 		return "", "", nil
 	case l < 4:
 		return "", "", fmt.Errorf("Command too short: %q", line)
-	case l == 4:
-		return strings.ToUpper(line), "", nil
-	case l == 5:
-		// Too long to be only command, too short to have args
-		return "", "", fmt.Errorf("Mangled command: %q", line)
 	}
 
-	// If we made it here, command is long enough to have args
-	if line[4] != ' ' {
-		// There wasn't a space after the command?
+	// Commands may be longer than 4 characters, e.g. XCLIENT
+	cmd = line
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		cmd, arg = line[:i], line[i+1:]
+	}
+	if len(cmd) < 4 {
 		return "", "", fmt.Errorf("Mangled command: %q", line)
 	}
 
 	// I'm not sure if we should trim the args or not, but we will for now
-	//return strings.ToUpper(line[0:4]), strings.Trim(line[5:], " "), nil
-	return strings.ToUpper(line[0:4]), strings.Trim(line[5:], " \n\r"), nil
+	return strings.ToUpper(cmd), strings.Trim(arg, " \n\r"), nil
 }
 
 // Takes the arguments proceeding a command and files them
@@ -58,6 +55,65 @@ func parseArgs(args []string) (map[string]string, error) {
 	return argMap, nil
 }
 
+// parseXClientArgs parses the attributes of the XCLIENT and XFORWARD
+// commands. Attribute names are uppercased and values are xtext-decoded.
+// Values of unavailable attributes are returned as empty strings.
+func parseXClientArgs(arg string) (map[string]string, error) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Missing attributes")
+	}
+
+	attrs := make(map[string]string, len(fields))
+	for _, field := range fields {
+		i := strings.IndexByte(field, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("Malformed attribute: %q", field)
+		}
+		name, value := strings.ToUpper(field[:i]), field[i+1:]
+		value, err := decodeXtext(value)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed attribute value: %q", field)
+		}
+		switch strings.ToUpper(value) {
+		case "[UNAVAILABLE]", "[TEMPUNAVAIL]":
+			value = ""
+		}
+		attrs[name] = value
+	}
+	return attrs, nil
+}
+
+// parseRcptPath parses the forward-path of a RCPT command, e.g.
+// "<root@example.org>". The angle brackets may only be omitted when strict
+// is false. A source route, if any, is discarded as permitted by RFC 5321
+// section 3.3.
+func parseRcptPath(path string, strict bool) (string, error) {
+	if strings.HasPrefix(path, "<") {
+		if !strings.HasSuffix(path, ">") || len(path) < 2 {
+			return "", fmt.Errorf("Unbalanced angle brackets")
+		}
+		path = path[1 : len(path)-1]
+	} else if strict {
+		return "", fmt.Errorf("Missing angle brackets")
+	}
+	if strings.ContainsAny(path, "<>") {
+		return "", fmt.Errorf("Unexpected angle bracket")
+	}
+
+	if strings.HasPrefix(path, "@") {
+		i := strings.IndexByte(path, ':')
+		if i < 0 {
+			return "", fmt.Errorf("Malformed source route")
+		}
+		path = path[i+1:]
+	}
+	if path == "" {
+		return "", fmt.Errorf("Empty address")
+	}
+	return path, nil
+}
+
 func parseHelloArgument(arg string) (string, error) {
 	domain := arg
 	if idx := strings.IndexRune(arg, ' '); idx >= 0 {
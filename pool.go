@@ -0,0 +1,247 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// Default maximum number of idle connections kept by a Pool.
+const defaultMaxIdle = 2
+
+// ErrPoolClosed is returned by Pool methods after a call to Close.
+var ErrPoolClosed = errors.New("smtp: pool closed")
+
+// A Pool keeps connections to an SMTP server alive and reuses them to send
+// messages. It is safe for concurrent use by multiple goroutines.
+//
+// Connections are health-checked with NOOP before being reused, and RSET is
+// sent after a failed mail transaction. A connection is discarded after an
+// I/O error or a 421 reply. Idle connections are closed in the background
+// once IdleTimeout has elapsed.
+type Pool struct {
+	// Dial opens a new connection to the server. The returned Client must be
+	// ready to send messages, e.g. after STARTTLS and AUTH.
+	Dial func(ctx context.Context) (*Client, error)
+
+	// Maximum number of idle connections kept. If zero, defaultMaxIdle is
+	// used.
+	MaxIdle int
+	// Maximum number of messages sent over a connection. Zero means no
+	// limit.
+	MaxMessages int
+	// Idle connections are closed after this duration. Zero means no limit.
+	IdleTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   []*pooledClient // oldest first
+	closed bool
+	reaper *time.Timer // closes expired idle connections
+}
+
+type pooledClient struct {
+	*Client
+	messages  int
+	idleSince time.Time
+}
+
+// SendMail sends a message with a pooled connection. See Client.SendMail.
+// Unlike Client.SendMail, it doesn't close the connection.
+func (p *Pool) SendMail(ctx context.Context, from string, to []string, r io.Reader) error {
+	return p.do(ctx, func(c *Client) error {
+		return c.sendMail(from, to, r)
+	})
+}
+
+// SendTransaction runs a mail transaction with a pooled connection. See
+// Client.SendTransaction.
+func (p *Pool) SendTransaction(ctx context.Context, from string, opts *MailOptions, rcpts []Recipient, r io.Reader) (*TransactionResult, error) {
+	var result *TransactionResult
+	err := p.do(ctx, func(c *Client) error {
+		var err error
+		result, err = c.SendTransaction(from, opts, rcpts, r)
+		return err
+	})
+	return result, err
+}
+
+// do runs a mail transaction with a pooled connection.
+func (p *Pool) do(ctx context.Context, f func(c *Client) error) error {
+	pc, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = pc.withContext(ctx, func() error {
+		return f(pc.Client)
+	})
+	pc.messages++
+
+	if pc.inData || isFatalError(err) {
+		pc.Close()
+	} else {
+		p.put(ctx, pc, err != nil)
+	}
+	return err
+}
+
+// Close closes the idle connections. Connections in use are closed once the
+// message is sent.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	if p.reaper != nil {
+		p.reaper.Stop()
+		p.reaper = nil
+	}
+	p.mu.Unlock()
+
+	for _, pc := range idle {
+		pc.quit()
+	}
+	return nil
+}
+
+// get returns an idle connection, or dials a new one.
+func (p *Pool) get(ctx context.Context) (*pooledClient, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		// Most recently used connections are the most likely to be alive
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if p.expired(pc) {
+			pc.quit()
+			continue
+		}
+		err := pc.withContext(ctx, pc.Noop)
+		if err == nil {
+			return pc, nil
+		}
+		pc.Close()
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+
+	c, err := p.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledClient{Client: c}, nil
+}
+
+// put returns a connection to the pool. If reset is true, the current mail
+// transaction is aborted first.
+func (p *Pool) put(ctx context.Context, pc *pooledClient, reset bool) {
+	if p.MaxMessages > 0 && pc.messages >= p.MaxMessages {
+		pc.quit()
+		return
+	}
+	if reset {
+		if err := pc.withContext(ctx, pc.Reset); err != nil {
+			pc.Close()
+			return
+		}
+	}
+
+	maxIdle := p.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdle
+	}
+
+	pc.idleSince = time.Now()
+
+	p.mu.Lock()
+	expired := p.removeExpired()
+	full := p.closed || len(p.idle) >= maxIdle
+	if !full {
+		p.idle = append(p.idle, pc)
+		if p.IdleTimeout > 0 && p.reaper == nil {
+			p.reaper = time.AfterFunc(p.IdleTimeout, p.reap)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, other := range expired {
+		other.quit()
+	}
+	if full {
+		pc.quit()
+	}
+}
+
+// reap closes the expired idle connections, and schedules the next run if
+// some idle connections remain.
+func (p *Pool) reap() {
+	p.mu.Lock()
+	expired := p.removeExpired()
+	p.reaper = nil
+	if len(p.idle) > 0 && !p.closed {
+		d := time.Until(p.idle[0].idleSince.Add(p.IdleTimeout))
+		p.reaper = time.AfterFunc(d, p.reap)
+	}
+	p.mu.Unlock()
+
+	for _, pc := range expired {
+		pc.quit()
+	}
+}
+
+// removeExpired removes the expired connections from the idle list and
+// returns them. p.mu must be locked.
+func (p *Pool) removeExpired() []*pooledClient {
+	var expired []*pooledClient
+	idle := p.idle[:0]
+	for _, pc := range p.idle {
+		if p.expired(pc) {
+			expired = append(expired, pc)
+		} else {
+			idle = append(idle, pc)
+		}
+	}
+	p.idle = idle
+	return expired
+}
+
+func (p *Pool) expired(pc *pooledClient) bool {
+	return p.IdleTimeout > 0 && time.Since(pc.idleSince) > p.IdleTimeout
+}
+
+// quit closes the connection gracefully.
+func (pc *pooledClient) quit() {
+	if err := pc.Quit(); err != nil {
+		pc.Close()
+	}
+}
+
+// isFatalError reports whether a connection can't be used anymore after
+// err. Only I/O errors and 421 replies are fatal: local errors, e.g. an
+// invalid address, don't reach the server.
+func isFatalError(err error) bool {
+	switch err := err.(type) {
+	case nil:
+		return false
+	case *SMTPError:
+		return err.Code == 421
+	case net.Error, *textproto.ProtocolError:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,213 @@
+package smtp_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func testPool(t *testing.T) (be *backend, s *smtp.Server, p *smtp.Pool, dials *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be = new(backend)
+	s = smtp.NewServer(be)
+	s.Domain = "localhost"
+	go s.Serve(l)
+
+	dials = new(int32)
+	p = &smtp.Pool{
+		Dial: func(ctx context.Context) (*smtp.Client, error) {
+			atomic.AddInt32(dials, 1)
+			return smtp.DialContext(ctx, l.Addr().String())
+		},
+	}
+	return
+}
+
+func TestPool(t *testing.T) {
+	be, s, p, dials := testPool(t)
+	defer s.Close()
+	defer p.Close()
+	p.MaxMessages = 2
+
+	for i := 0; i < 3; i++ {
+		err := p.SendMail(context.Background(), "root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n"))
+		if err != nil {
+			t.Fatalf("SendMail #%v: %v", i, err)
+		}
+	}
+
+	if len(be.anonmsgs) != 3 {
+		t.Fatal("Invalid number of sent messages:", len(be.anonmsgs))
+	}
+	if n := atomic.LoadInt32(dials); n != 2 {
+		t.Fatal("Invalid number of connections:", n)
+	}
+}
+
+func TestPool_Reset(t *testing.T) {
+	be, s, p, dials := testPool(t)
+	defer s.Close()
+	defer p.Close()
+	s.MaxRecipients = 1
+
+	err := p.SendMail(context.Background(), "root@nsa.gov", []string{"root@gchq.gov.uk", "root@bnd.bund.de"}, strings.NewReader("Hey <3\r\n"))
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 552 {
+		t.Fatalf("SendMail returned %v; want 552 error", err)
+	}
+
+	// The connection is reset and reused
+	err = p.SendMail(context.Background(), "root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("SendMail: %v", err)
+	}
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", len(be.anonmsgs))
+	}
+	if n := atomic.LoadInt32(dials); n != 1 {
+		t.Fatal("Invalid number of connections:", n)
+	}
+}
+
+func TestPool_Broken(t *testing.T) {
+	_, s, p, dials := testPool(t)
+	defer s.Close()
+	defer p.Close()
+
+	if err := p.SendMail(context.Background(), "root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("SendMail: %v", err)
+	}
+
+	// Idle connections fail the health check and are replaced
+	s.ForEachConn(func(c *smtp.Conn) {
+		c.Close()
+	})
+	time.Sleep(10 * time.Millisecond)
+
+	if err := p.SendMail(context.Background(), "root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("SendMail: %v", err)
+	}
+	if n := atomic.LoadInt32(dials); n != 2 {
+		t.Fatal("Invalid number of connections:", n)
+	}
+}
+
+func TestPool_Concurrent(t *testing.T) {
+	be, s, p, _ := testPool(t)
+	defer s.Close()
+	defer p.Close()
+	p.MaxIdle = 4
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rcpts := []smtp.Recipient{{Addr: "root@gchq.gov.uk"}}
+			_, err := p.SendTransaction(context.Background(), "root@nsa.gov", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("SendTransaction: %v", err)
+		}
+	}
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if n := len(be.anonmsgs); n != 20 {
+		t.Fatal("Invalid number of sent messages:", n)
+	}
+}
+
+func TestPool_LocalError(t *testing.T) {
+	be, s, p, dials := testPool(t)
+	defer s.Close()
+	defer p.Close()
+
+	// Invalid addresses are rejected before reaching the server
+	err := p.SendMail(context.Background(), "root@nsa.gov\r\nRSET", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n"))
+	if err == nil {
+		t.Fatal("SendMail succeeded with an invalid address")
+	}
+
+	err = p.SendMail(context.Background(), "root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("SendMail: %v", err)
+	}
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", len(be.anonmsgs))
+	}
+	if n := atomic.LoadInt32(dials); n != 1 {
+		t.Fatal("Invalid number of connections:", n)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read(b []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestPool_ReaderError(t *testing.T) {
+	be, s, p, dials := testPool(t)
+	defer s.Close()
+	defer p.Close()
+
+	// With BDAT, the transaction is reset and the connection reused
+	r := io.MultiReader(strings.NewReader("Hey <3\r\n"), errReader{})
+	err := p.SendMail(context.Background(), "root@nsa.gov", []string{"root@gchq.gov.uk"}, r)
+	if err == nil {
+		t.Fatal("SendMail succeeded with a failing reader")
+	}
+
+	err = p.SendMail(context.Background(), "root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("SendMail: %v", err)
+	}
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", len(be.anonmsgs))
+	}
+	if n := atomic.LoadInt32(dials); n != 1 {
+		t.Fatal("Invalid number of connections:", n)
+	}
+}
+
+func TestPool_IdleTimeout(t *testing.T) {
+	_, s, p, _ := testPool(t)
+	defer s.Close()
+	defer p.Close()
+	p.IdleTimeout = 20 * time.Millisecond
+
+	if err := p.SendMail(context.Background(), "root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("SendMail: %v", err)
+	}
+
+	// Idle connections are closed without using the pool
+	conns := -1
+	for i := 0; i < 50 && conns != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		conns = 0
+		s.ForEachConn(func(c *smtp.Conn) {
+			conns++
+		})
+	}
+	if conns != 0 {
+		t.Fatal("Idle connection not closed:", conns)
+	}
+}
@@ -0,0 +1,393 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocol configures support for the HAProxy PROXY protocol, versions 1
+// and 2, as defined in
+// https://www.haproxy.org/download/2.6/doc/proxy-protocol.txt
+type ProxyProtocol struct {
+	// Networks allowed to send a PROXY header. Connections from trusted
+	// networks must start with a PROXY header, other connections are handled
+	// as direct connections. If empty, no address is trusted: the proxy
+	// networks must be listed explicitly, otherwise any client could spoof
+	// its address.
+	TrustedNetworks []*net.IPNet
+
+	// Maximum time to wait for the PROXY header. Zero means no timeout.
+	HeaderTimeout time.Duration
+}
+
+func (p *ProxyProtocol) trusted(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+
+	for _, n := range p.TrustedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// PROXY protocol v2 TLV types.
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02
+	ProxyTLVCRC32C    = 0x03
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20
+	ProxyTLVNetNS     = 0x30
+
+	ProxyTLVSSLVersion = 0x21
+	ProxyTLVSSLCN      = 0x22
+	ProxyTLVSSLCipher  = 0x23
+	ProxyTLVSSLSigAlg  = 0x24
+	ProxyTLVSSLKeyAlg  = 0x25
+)
+
+// ProxyTLV is a type-length-value field sent in a PROXY protocol v2 header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader contains the information received in a PROXY protocol header.
+type ProxyHeader struct {
+	// Version of the PROXY protocol, 1 or 2.
+	Version int
+	// Local is true if the proxy did not relay a client connection (v2 LOCAL
+	// command or v1 UNKNOWN protocol), e.g. for health checks. Addresses are
+	// nil in this case.
+	Local bool
+
+	SourceAddr net.Addr
+	DestAddr   net.Addr
+
+	// TLV fields, only sent with version 2.
+	TLVs []ProxyTLV
+}
+
+// TLV returns the value of the first TLV field with the given type.
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Authority returns the host name sent by the client using SNI, if any.
+func (h *ProxyHeader) Authority() string {
+	v, _ := h.TLV(ProxyTLVAuthority)
+	return string(v)
+}
+
+// ProxySSL contains information about the TLS connection between the client
+// and the proxy.
+type ProxySSL struct {
+	// Client is a bit field indicating whether the client connected over TLS
+	// (0x01), sent a certificate over the connection (0x02) or sent a
+	// certificate at least once over the session (0x04).
+	Client byte
+	// The client provided a certificate which was successfully verified.
+	Verified bool
+
+	Version    string
+	CommonName string
+	Cipher     string
+	SigAlg     string
+	KeyAlg     string
+}
+
+// SSL decodes the SSL TLV field, if any.
+func (h *ProxyHeader) SSL() (*ProxySSL, error) {
+	v, ok := h.TLV(ProxyTLVSSL)
+	if !ok {
+		return nil, nil
+	}
+	if len(v) < 5 {
+		return nil, errors.New("smtp: malformed PROXY SSL TLV")
+	}
+
+	ssl := &ProxySSL{
+		Client:   v[0],
+		Verified: binary.BigEndian.Uint32(v[1:5]) == 0,
+	}
+	tlvs, err := parseProxyTLVs(v[5:])
+	if err != nil {
+		return nil, err
+	}
+	for _, tlv := range tlvs {
+		switch tlv.Type {
+		case ProxyTLVSSLVersion:
+			ssl.Version = string(tlv.Value)
+		case ProxyTLVSSLCN:
+			ssl.CommonName = string(tlv.Value)
+		case ProxyTLVSSLCipher:
+			ssl.Cipher = string(tlv.Value)
+		case ProxyTLVSSLSigAlg:
+			ssl.SigAlg = string(tlv.Value)
+		case ProxyTLVSSLKeyAlg:
+			ssl.KeyAlg = string(tlv.Value)
+		}
+	}
+	return ssl, nil
+}
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Maximum length of a v1 header, including CRLF.
+const proxyV1MaxLen = 107
+
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	sig, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case string(sig) == "PROXY":
+		return readProxyHeaderV1(r)
+	case bytes.Equal(sig, proxyV2Sig[:5]):
+		return readProxyHeaderV2(r)
+	default:
+		return nil, errors.New("smtp: missing PROXY header")
+	}
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("smtp: PROXY header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("smtp: malformed PROXY header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, errors.New("smtp: malformed PROXY header")
+	}
+
+	h := &ProxyHeader{Version: 1}
+	switch fields[1] {
+	case "UNKNOWN":
+		h.Local = true
+		return h, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("smtp: unsupported PROXY protocol %q", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, errors.New("smtp: malformed PROXY header")
+	}
+	srcIP := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	if srcIP == nil || dstIP == nil {
+		return nil, errors.New("smtp: malformed PROXY header address")
+	}
+	if (srcIP.To4() != nil) != (fields[1] == "TCP4") || (dstIP.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errors.New("smtp: PROXY header address does not match protocol")
+	}
+	srcPort, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errors.New("smtp: malformed PROXY header port")
+	}
+	dstPort, err := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return nil, errors.New("smtp: malformed PROXY header port")
+	}
+
+	h.SourceAddr = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	h.DestAddr = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return h, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*ProxyHeader, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Sig) {
+		return nil, errors.New("smtp: malformed PROXY header signature")
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("smtp: unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &ProxyHeader{Version: 2}
+	switch hdr[12] & 0x0F {
+	case 0x0: // LOCAL
+		h.Local = true
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("smtp: unsupported PROXY command %d", hdr[12]&0x0F)
+	}
+
+	var addrLen int
+	switch fam := hdr[13]; fam >> 4 {
+	case 0x0: // AF_UNSPEC
+		h.Local = true
+	case 0x1: // AF_INET
+		addrLen = 12
+		if len(payload) < addrLen {
+			return nil, errors.New("smtp: PROXY header too short")
+		}
+		if !h.Local {
+			h.SourceAddr, h.DestAddr = proxyV2IPAddrs(fam, payload[0:4], payload[4:8], payload[8:12])
+		}
+	case 0x2: // AF_INET6
+		addrLen = 36
+		if len(payload) < addrLen {
+			return nil, errors.New("smtp: PROXY header too short")
+		}
+		if !h.Local {
+			h.SourceAddr, h.DestAddr = proxyV2IPAddrs(fam, payload[0:16], payload[16:32], payload[32:36])
+		}
+	case 0x3: // AF_UNIX
+		addrLen = 216
+		if len(payload) < addrLen {
+			return nil, errors.New("smtp: PROXY header too short")
+		}
+		if !h.Local {
+			network := "unix"
+			if fam&0x0F == 0x2 {
+				network = "unixgram"
+			}
+			h.SourceAddr = &net.UnixAddr{Name: string(bytes.TrimRight(payload[0:108], "\x00")), Net: network}
+			h.DestAddr = &net.UnixAddr{Name: string(bytes.TrimRight(payload[108:216], "\x00")), Net: network}
+		}
+	default:
+		return nil, fmt.Errorf("smtp: unsupported PROXY address family %d", fam>>4)
+	}
+
+	tlvs, err := parseProxyTLVs(payload[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+	return h, nil
+}
+
+func proxyV2IPAddrs(fam byte, src, dst, ports []byte) (net.Addr, net.Addr) {
+	srcIP := append(net.IP(nil), src...)
+	dstIP := append(net.IP(nil), dst...)
+	srcPort := int(binary.BigEndian.Uint16(ports[0:2]))
+	dstPort := int(binary.BigEndian.Uint16(ports[2:4]))
+	if fam&0x0F == 0x2 { // DGRAM
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}
+}
+
+func parseProxyTLVs(b []byte) ([]ProxyTLV, error) {
+	var tlvs []ProxyTLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errors.New("smtp: malformed PROXY TLV")
+		}
+		l := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+l {
+			return nil, errors.New("smtp: malformed PROXY TLV")
+		}
+		tlvs = append(tlvs, ProxyTLV{Type: b[0], Value: b[3 : 3+l]})
+		b = b[3+l:]
+	}
+	return tlvs, nil
+}
+
+// proxyListener wraps connections accepted from trusted peers in proxyConn.
+type proxyListener struct {
+	net.Listener
+	proxy *ProxyProtocol
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.proxy.trusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c), timeout: l.proxy.HeaderTimeout}, nil
+}
+
+// proxyConn reads the PROXY header the first time it is used.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *ProxyHeader
+	err    error
+}
+
+func (c *proxyConn) readHeader() error {
+	c.once.Do(func() {
+		if c.timeout != 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.header, c.err = readProxyHeader(c.r)
+	})
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.readHeader() != nil || c.header.Local || c.header.SourceAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.header.SourceAddr
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.readHeader() != nil || c.header.Local || c.header.DestAddr == nil {
+		return c.Conn.LocalAddr()
+	}
+	return c.header.DestAddr
+}
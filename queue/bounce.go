@@ -0,0 +1,233 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// bounce sends a delivery status notification (RFC 3464) to the sender of a
+// message for the recipients which failed since the last notification. The
+// recipients are marked as reported. Nothing is sent if the message is itself
+// a notification or if the recipients didn't ask for it.
+func (q *Queue) bounce(msg *Message) error {
+	var failed []int
+	for i, rcpt := range msg.Recipients {
+		if rcpt.Status == StatusFailed && !rcpt.Reported {
+			failed = append(failed, i)
+		}
+	}
+
+	var report []Recipient
+	for _, i := range failed {
+		if notifyFailure(msg.Recipients[i].Opts) {
+			report = append(report, msg.Recipients[i])
+		}
+	}
+	if len(report) > 0 && msg.From == "" {
+		q.logf("queue: dropping undeliverable notification %v", msg.ID)
+	} else if len(report) > 0 {
+		if err := q.sendBounce(msg, report); err != nil {
+			return err
+		}
+	}
+
+	for _, i := range failed {
+		msg.Recipients[i].Reported = true
+	}
+	return nil
+}
+
+func (q *Queue) sendBounce(msg *Message, failed []Recipient) error {
+	f, err := os.Open(q.path(msg.ID, ".msg"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	if err := q.writeBounce(&buf, msg, failed, f); err != nil {
+		return err
+	}
+
+	rcpts := []smtp.Recipient{{Addr: msg.From}}
+	_, err = q.Enqueue("", nil, rcpts, &buf)
+	return err
+}
+
+func (q *Queue) writeBounce(w io.Writer, msg *Message, failed []Recipient, r io.Reader) error {
+	hostname := q.hostname()
+	now := time.Now()
+	msgID, err := newID()
+	if err != nil {
+		return err
+	}
+
+	mw := multipart.NewWriter(w)
+
+	fmt.Fprintf(w, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", hostname)
+	fmt.Fprintf(w, "To: <%s>\r\n", msg.From)
+	fmt.Fprintf(w, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(w, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(w, "Message-Id: <%s@%s>\r\n", msgID, hostname)
+	fmt.Fprintf(w, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(w, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(w, "Content-Type: multipart/report; report-type=delivery-status;\r\n")
+	fmt.Fprintf(w, "\tboundary=%q\r\n", mw.Boundary())
+	fmt.Fprintf(w, "\r\n")
+
+	// Human-readable explanation
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(pw, "This is the mail system at host %s.\r\n\r\n", hostname)
+	fmt.Fprintf(pw, "Your message could not be delivered to one or more recipients.\r\n\r\n")
+	for _, rcpt := range failed {
+		fmt.Fprintf(pw, "<%s>: %s\r\n", rcpt.Addr, describeFailure(&rcpt))
+	}
+
+	// Machine-readable delivery status
+	h = make(textproto.MIMEHeader)
+	h.Set("Content-Type", "message/delivery-status")
+	pw, err = mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(pw, "Reporting-MTA: dns; %s\r\n", hostname)
+	if msg.Opts != nil && msg.Opts.EnvelopeID != "" {
+		fmt.Fprintf(pw, "Original-Envelope-Id: %s\r\n", msg.Opts.EnvelopeID)
+	}
+	fmt.Fprintf(pw, "Arrival-Date: %s\r\n", msg.Created.Format(time.RFC1123Z))
+	for _, rcpt := range failed {
+		fmt.Fprintf(pw, "\r\n")
+		if rcpt.Opts != nil && rcpt.Opts.OriginalRecipient != "" {
+			addrType := rcpt.Opts.OriginalRecipientType
+			if addrType == "" {
+				addrType = smtp.DSNAddressTypeRFC822
+			}
+			fmt.Fprintf(pw, "Original-Recipient: %s; %s\r\n", strings.ToLower(string(addrType)), rcpt.Opts.OriginalRecipient)
+		}
+		fmt.Fprintf(pw, "Final-Recipient: rfc822; %s\r\n", rcpt.Addr)
+		fmt.Fprintf(pw, "Action: failed\r\n")
+		fmt.Fprintf(pw, "Status: %s\r\n", statusCode(rcpt.Err))
+		if rcpt.MX != "" {
+			fmt.Fprintf(pw, "Remote-MTA: dns; %s\r\n", rcpt.MX)
+		}
+		if rcpt.Remote && rcpt.Err != nil {
+			fmt.Fprintf(pw, "Diagnostic-Code: smtp; %d %s %s\r\n", rcpt.Err.Code, statusCode(rcpt.Err), oneLine(rcpt.Err.Message))
+		}
+		if msg.Attempts > 0 {
+			fmt.Fprintf(pw, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+		}
+	}
+
+	// Original message
+	headersOnly := msg.Opts != nil && msg.Opts.Return == smtp.DSNReturnHeaders
+	h = make(textproto.MIMEHeader)
+	if headersOnly {
+		h.Set("Content-Type", "text/rfc822-headers")
+	} else {
+		h.Set("Content-Type", "message/rfc822")
+	}
+	pw, err = mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	if headersOnly {
+		err = copyHeader(pw, r)
+	} else {
+		_, err = io.Copy(pw, r)
+	}
+	if err != nil {
+		return err
+	}
+
+	return mw.Close()
+}
+
+func (q *Queue) hostname() string {
+	if q.Hostname != "" {
+		return q.Hostname
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "localhost"
+}
+
+// notifyFailure checks whether a failure notification has been requested
+// for a recipient. Without a NOTIFY parameter, failures are reported.
+func notifyFailure(opts *smtp.RcptOptions) bool {
+	if opts == nil || len(opts.Notify) == 0 {
+		return true
+	}
+	for _, notify := range opts.Notify {
+		if notify == smtp.DSNNotifyFailure {
+			return true
+		}
+	}
+	return false
+}
+
+func describeFailure(rcpt *Recipient) string {
+	if rcpt.Err == nil {
+		return "delivery failed"
+	}
+	msg := oneLine(rcpt.Err.Message)
+	if rcpt.Remote {
+		return fmt.Sprintf("host %s said: %d %s", rcpt.MX, rcpt.Err.Code, msg)
+	}
+	return msg
+}
+
+// statusCode formats the enhanced status code (RFC 3463) of an error. If the
+// error has no enhanced code, one is derived from the reply code.
+func statusCode(err *smtp.SMTPError) string {
+	if err == nil {
+		return "5.0.0"
+	}
+	code := err.EnhancedCode
+	if code == smtp.EnhancedCodeNotSet || code == smtp.NoEnhancedCode {
+		class := err.Code / 100
+		if class != 4 && class != 5 {
+			class = 5
+		}
+		return fmt.Sprintf("%d.0.0", class)
+	}
+	return fmt.Sprintf("%d.%d.%d", code[0], code[1], code[2])
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// copyHeader copies the header of a message, without the body.
+func copyHeader(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if strings.TrimRight(line, "\r\n") == "" {
+			return nil
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,665 @@
+// Package queue implements a persistent outbound mail queue.
+//
+// Messages are spooled to a directory and delivered by a pool of workers.
+// Transient failures are retried with an exponential backoff, and delivery
+// status notifications (RFC 3464) are sent back to the sender after a
+// permanent failure or when a message expires.
+package queue
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	defaultWorkers          = 4
+	defaultRetryInterval    = 5 * time.Minute
+	defaultMaxRetryInterval = 4 * time.Hour
+	defaultMaxLifetime      = 5 * 24 * time.Hour
+)
+
+// ErrNotFound is returned when a message isn't in the queue.
+var ErrNotFound = errors.New("queue: message not found")
+
+// ErrClosed is returned by Queue methods after a call to Close.
+var ErrClosed = errors.New("queue: closed")
+
+// A Transport delivers messages. It is implemented by *smtp.Deliverer.
+type Transport interface {
+	// Deliver sends a message to the recipients. The returned results must
+	// be in the same order as rcpts. An error fails the delivery attempt for
+	// all recipients with a transient error.
+	Deliver(ctx context.Context, from string, opts *smtp.MailOptions, rcpts []smtp.Recipient, r io.Reader) ([]smtp.DeliveryResult, error)
+}
+
+// Status is the delivery status of a recipient.
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusDelivered Status = "delivered"
+	StatusFailed    Status = "failed"
+)
+
+// Recipient is a recipient of a queued message.
+type Recipient struct {
+	smtp.Recipient
+
+	Status Status
+	// The mail exchanger used by the last delivery attempt, if any.
+	MX string
+	// The error of the last delivery attempt, if any.
+	Err *smtp.SMTPError
+	// Whether Err is a reply sent by MX.
+	Remote bool
+	// Whether the failure has been reported to the sender, if requested.
+	Reported bool
+}
+
+// Message is a queued message.
+type Message struct {
+	ID         string
+	From       string
+	Opts       *smtp.MailOptions
+	Recipients []Recipient
+
+	// Time the message was added to the queue.
+	Created time.Time
+	// Number of delivery attempts.
+	Attempts int
+	// Time of the next delivery attempt.
+	NextAttempt time.Time
+}
+
+func (msg *Message) copy() *Message {
+	cp := *msg
+	cp.Recipients = append([]Recipient(nil), msg.Recipients...)
+	return &cp
+}
+
+type item struct {
+	msg  *Message
+	busy bool // a worker is delivering the message
+}
+
+// A Queue is a persistent outbound mail queue. It is safe for concurrent use
+// by multiple goroutines.
+type Queue struct {
+	// Transport delivers the messages.
+	Transport Transport
+
+	// Number of concurrent deliveries. If zero, defaultWorkers is used.
+	Workers int
+	// Delay before the first retry. It is doubled after each attempt, up to
+	// MaxRetryInterval. If zero, defaultRetryInterval is used.
+	RetryInterval time.Duration
+	// Maximum delay between two attempts. If zero, defaultMaxRetryInterval
+	// is used.
+	MaxRetryInterval time.Duration
+	// Messages which couldn't be delivered after this duration are bounced.
+	// If zero, defaultMaxLifetime is used.
+	MaxLifetime time.Duration
+
+	// Hostname of this MTA, used in delivery status notifications. If empty,
+	// os.Hostname is used.
+	Hostname string
+	// Logger for delivery errors. If nil, errors are logged to os.Stderr.
+	ErrorLog *log.Logger
+
+	dir string
+
+	mu      sync.Mutex
+	items   map[string]*item
+	wakeCh  chan struct{} // closed to wake up idle workers
+	started bool
+	closed  bool
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// Open opens the queue stored in dir, creating the directory if needed.
+// Messages left in the queue by a previous process are loaded. Start must be
+// called to deliver them.
+func Open(dir string, t Transport) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		Transport: t,
+		dir:       dir,
+		items:     make(map[string]*item),
+		wakeCh:    make(chan struct{}),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// load reads the messages stored in the queue directory. Files left over by
+// an interrupted Enqueue are removed.
+func (q *Queue) load() error {
+	entries, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+
+	envelopes := make(map[string]bool)
+	bodies := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		switch filepath.Ext(name) {
+		case ".json":
+			envelopes[strings.TrimSuffix(name, ".json")] = true
+		case ".msg":
+			bodies[strings.TrimSuffix(name, ".msg")] = true
+		case ".tmp":
+			os.Remove(filepath.Join(q.dir, name))
+		}
+	}
+
+	for id := range bodies {
+		if !envelopes[id] {
+			os.Remove(q.path(id, ".msg"))
+		}
+	}
+	for id := range envelopes {
+		if !bodies[id] {
+			os.Remove(q.path(id, ".json"))
+			continue
+		}
+
+		b, err := ioutil.ReadFile(q.path(id, ".json"))
+		if err != nil {
+			return err
+		}
+		var msg Message
+		if err := json.Unmarshal(b, &msg); err != nil {
+			return err
+		}
+		q.items[id] = &item{msg: &msg}
+	}
+	return nil
+}
+
+// Start starts delivering messages in the background.
+func (q *Queue) Start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.started || q.closed {
+		return
+	}
+	q.started = true
+
+	workers := q.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	var ctx context.Context
+	ctx, q.cancel = context.WithCancel(context.Background())
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.worker(ctx)
+	}
+}
+
+// Close stops the delivery workers. Deliveries in progress are aborted and
+// will be retried when the queue is opened again.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	q.closed = true
+	cancel := q.cancel
+	q.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	q.wg.Wait()
+	return nil
+}
+
+// Enqueue adds a message to the queue and returns its ID. The message is
+// stored on disk before Enqueue returns.
+func (q *Queue) Enqueue(from string, opts *smtp.MailOptions, rcpts []smtp.Recipient, r io.Reader) (string, error) {
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+	if err := writeFile(q.path(id, ".msg"), r); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	msg := &Message{
+		ID:          id,
+		From:        from,
+		Opts:        opts,
+		Recipients:  make([]Recipient, len(rcpts)),
+		Created:     now,
+		NextAttempt: now,
+	}
+	for i, rcpt := range rcpts {
+		msg.Recipients[i] = Recipient{Recipient: rcpt, Status: StatusPending}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		os.Remove(q.path(id, ".msg"))
+		return "", ErrClosed
+	}
+	if err := q.save(msg); err != nil {
+		os.Remove(q.path(id, ".msg"))
+		return "", err
+	}
+	q.items[id] = &item{msg: msg}
+	q.wake()
+	return id, nil
+}
+
+// List returns the messages in the queue, oldest first.
+func (q *Queue) List() []*Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := make([]*Message, 0, len(q.items))
+	for _, it := range q.items {
+		l = append(l, it.msg.copy())
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Created.Before(l[j].Created)
+	})
+	return l
+}
+
+// Get returns a message from the queue.
+func (q *Queue) Get(id string) (*Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	it, ok := q.items[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return it.msg.copy(), nil
+}
+
+// Flush schedules an immediate delivery attempt for all queued messages.
+func (q *Queue) Flush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for _, it := range q.items {
+		if !it.busy {
+			it.msg.NextAttempt = now
+		}
+	}
+	q.wake()
+}
+
+// Delete removes a message from the queue without sending a delivery status
+// notification. If the message is being delivered, the delivery isn't
+// aborted.
+func (q *Queue) Delete(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.items[id]; !ok {
+		return ErrNotFound
+	}
+	delete(q.items, id)
+	return q.remove(id)
+}
+
+// wake wakes up idle workers. It must be called with q.mu locked.
+func (q *Queue) wake() {
+	close(q.wakeCh)
+	q.wakeCh = make(chan struct{})
+}
+
+func (q *Queue) worker(ctx context.Context) {
+	defer q.wg.Done()
+
+	for {
+		it, wait, wakeCh := q.next(ctx)
+		if it != nil {
+			q.deliver(ctx, it)
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+
+		var timer *time.Timer
+		var timerCh <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			timerCh = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-wakeCh:
+		case <-timerCh:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// next picks a message due for delivery. If there is none, it returns the
+// delay until the next attempt, or a negative delay if the queue is empty,
+// and a channel closed when new messages are due. No message is picked once
+// ctx is done.
+func (q *Queue) next(ctx context.Context) (it *item, wait time.Duration, wakeCh <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if ctx.Err() != nil {
+		return nil, -1, q.wakeCh
+	}
+
+	var due *item
+	for _, it := range q.items {
+		if it.busy {
+			continue
+		}
+		if due == nil || it.msg.NextAttempt.Before(due.msg.NextAttempt) {
+			due = it
+		}
+	}
+	if due == nil {
+		return nil, -1, q.wakeCh
+	}
+	if wait := time.Until(due.msg.NextAttempt); wait > 0 {
+		return nil, wait, q.wakeCh
+	}
+	due.busy = true
+	return due, 0, nil
+}
+
+// deliver runs a delivery attempt for a message.
+func (q *Queue) deliver(ctx context.Context, it *item) {
+	q.mu.Lock()
+	msg := it.msg.copy()
+	q.mu.Unlock()
+
+	var (
+		pending []int
+		rcpts   []smtp.Recipient
+	)
+	for i, rcpt := range msg.Recipients {
+		if rcpt.Status == StatusPending {
+			pending = append(pending, i)
+			rcpts = append(rcpts, rcpt.Recipient)
+		}
+	}
+
+	results, err := q.send(ctx, msg, rcpts)
+	// Failures of a delivery aborted by Close aren't recorded, and the
+	// attempt doesn't count
+	aborted := ctx.Err() != nil
+	for i, j := range pending {
+		rcpt := &msg.Recipients[j]
+		if err != nil {
+			if aborted {
+				continue
+			}
+			rcpt.Err = toSMTPError(err)
+			rcpt.MX = ""
+			rcpt.Remote = false
+			continue
+		}
+
+		res := results[i]
+		rcpt.MX = res.MX
+		if res.Err == nil {
+			rcpt.Status = StatusDelivered
+			rcpt.Err = nil
+			rcpt.Remote = false
+			continue
+		} else if aborted {
+			continue
+		}
+		_, isReply := res.Err.(*smtp.SMTPError)
+		rcpt.Remote = isReply && res.MX != ""
+		rcpt.Err = toSMTPError(res.Err)
+		if !res.Temporary() {
+			rcpt.Status = StatusFailed
+		}
+	}
+	if aborted {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.items[msg.ID] != it {
+			return
+		}
+		// The queue is shutting down: the message stays busy so that no
+		// other worker picks it up
+		it.msg = msg
+		if err := q.save(msg); err != nil {
+			q.logf("queue: failed to save message %v: %v", msg.ID, err)
+		}
+		return
+	}
+	if len(pending) > 0 {
+		msg.Attempts++
+	}
+
+	now := time.Now()
+	if now.Sub(msg.Created) >= q.maxLifetime() {
+		for i := range msg.Recipients {
+			rcpt := &msg.Recipients[i]
+			if rcpt.Status != StatusPending {
+				continue
+			}
+			rcpt.Status = StatusFailed
+			if rcpt.Err == nil {
+				rcpt.Err = errExpired
+			}
+		}
+	}
+
+	q.mu.Lock()
+	deleted := q.items[msg.ID] != it
+	q.mu.Unlock()
+	if deleted {
+		return
+	}
+
+	if err := q.bounce(msg); err != nil {
+		q.logf("queue: failed to send notification for message %v: %v", msg.ID, err)
+	}
+
+	done, retry := true, false
+	for _, rcpt := range msg.Recipients {
+		if rcpt.Status == StatusPending {
+			done, retry = false, true
+		} else if rcpt.Status == StatusFailed && !rcpt.Reported {
+			done = false
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.items[msg.ID] != it {
+		return
+	}
+
+	if done {
+		delete(q.items, msg.ID)
+		if err := q.remove(msg.ID); err != nil {
+			q.logf("queue: failed to remove message %v: %v", msg.ID, err)
+		}
+		return
+	}
+
+	if retry {
+		msg.NextAttempt = now.Add(q.retryDelay(msg.Attempts))
+	} else {
+		// Only the notification needs to be sent again
+		msg.NextAttempt = now.Add(q.retryDelay(1))
+	}
+	it.msg = msg
+	it.busy = false
+	if err := q.save(msg); err != nil {
+		q.logf("queue: failed to save message %v: %v", msg.ID, err)
+	}
+}
+
+func (q *Queue) send(ctx context.Context, msg *Message, rcpts []smtp.Recipient) ([]smtp.DeliveryResult, error) {
+	if len(rcpts) == 0 {
+		return nil, nil
+	}
+
+	f, err := os.Open(q.path(msg.ID, ".msg"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	results, err := q.Transport.Deliver(ctx, msg.From, msg.Opts, rcpts, f)
+	if err == nil && len(results) != len(rcpts) {
+		err = errors.New("queue: transport returned an invalid number of results")
+	}
+	return results, err
+}
+
+// retryDelay returns the delay before the next attempt after a number of
+// failed attempts.
+func (q *Queue) retryDelay(attempts int) time.Duration {
+	interval := q.RetryInterval
+	if interval <= 0 {
+		interval = defaultRetryInterval
+	}
+	max := q.MaxRetryInterval
+	if max <= 0 {
+		max = defaultMaxRetryInterval
+	}
+
+	delay := interval
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (q *Queue) maxLifetime() time.Duration {
+	if q.MaxLifetime <= 0 {
+		return defaultMaxLifetime
+	}
+	return q.MaxLifetime
+}
+
+func (q *Queue) logf(format string, v ...interface{}) {
+	if q.ErrorLog != nil {
+		q.ErrorLog.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+func (q *Queue) path(id, ext string) string {
+	return filepath.Join(q.dir, id+ext)
+}
+
+// save writes the envelope of a message to disk.
+func (q *Queue) save(msg *Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return writeFile(q.path(msg.ID, ".json"), bytes.NewReader(b))
+}
+
+// remove deletes the files of a message. The envelope is removed first, so
+// that an interrupted removal doesn't leave a message without its body.
+func (q *Queue) remove(id string) error {
+	if err := os.Remove(q.path(id, ".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(q.path(id, ".msg")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFile atomically writes a file and syncs it to disk.
+func writeFile(path string, r io.Reader) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func newID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+var errExpired = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 4, 7},
+	Message:      "Message expired",
+}
+
+// toSMTPError converts a delivery error to an *smtp.SMTPError. Errors which
+// aren't replies are considered transient network errors.
+func toSMTPError(err error) *smtp.SMTPError {
+	if smtpErr, ok := err.(*smtp.SMTPError); ok {
+		return smtpErr
+	}
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 0},
+		Message:      err.Error(),
+	}
+}
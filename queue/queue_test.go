@@ -0,0 +1,349 @@
+package queue_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/queue"
+)
+
+type delivery struct {
+	From  string
+	Opts  *smtp.MailOptions
+	Rcpts []string
+	Data  string
+}
+
+type transport struct {
+	errs       map[string]error
+	deliveries chan *delivery
+}
+
+func newTransport(errs map[string]error) *transport {
+	return &transport{errs: errs, deliveries: make(chan *delivery, 10)}
+}
+
+func (t *transport) Deliver(ctx context.Context, from string, opts *smtp.MailOptions, rcpts []smtp.Recipient, r io.Reader) ([]smtp.DeliveryResult, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &delivery{From: from, Opts: opts, Data: string(b)}
+	results := make([]smtp.DeliveryResult, len(rcpts))
+	for i, rcpt := range rcpts {
+		d.Rcpts = append(d.Rcpts, rcpt.Addr)
+		results[i] = smtp.DeliveryResult{
+			Addr: rcpt.Addr,
+			MX:   "mx.example.org",
+			Err:  t.errs[rcpt.Addr],
+		}
+	}
+	t.deliveries <- d
+	return results, nil
+}
+
+// blockingTransport blocks deliveries until they're aborted.
+type blockingTransport struct {
+	started chan struct{}
+}
+
+func (t *blockingTransport) Deliver(ctx context.Context, from string, opts *smtp.MailOptions, rcpts []smtp.Recipient, r io.Reader) ([]smtp.DeliveryResult, error) {
+	select {
+	case t.started <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (t *transport) wait(test *testing.T) *delivery {
+	test.Helper()
+	select {
+	case d := <-t.deliveries:
+		return d
+	case <-time.After(5 * time.Second):
+		test.Fatal("Timed out waiting for a delivery")
+		return nil
+	}
+}
+
+func waitEmpty(t *testing.T, q *queue.Queue) {
+	for i := 0; i < 500; i++ {
+		if len(q.List()) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for the queue to be empty")
+}
+
+var (
+	errTemporary = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Try again later",
+	}
+	errPermanent = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "No such user",
+	}
+)
+
+const testMsg = "From: <root@example.edu>\r\n" +
+	"Subject: Hey\r\n" +
+	"\r\n" +
+	"Hey <3\r\n"
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-queue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tr := newTransport(map[string]error{
+		"bob@example.org":   errTemporary,
+		"carol@example.org": errPermanent,
+	})
+	q, err := queue.Open(dir, tr)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	q.Hostname = "mx.example.edu"
+	q.RetryInterval = time.Hour
+	q.Start()
+
+	rcpts := []smtp.Recipient{
+		{Addr: "alice@example.org"},
+		{Addr: "bob@example.org"},
+		{Addr: "carol@example.org"},
+	}
+	opts := &smtp.MailOptions{EnvelopeID: "QQ314159"}
+	id, err := q.Enqueue("root@example.edu", opts, rcpts, strings.NewReader(testMsg))
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	d := tr.wait(t)
+	if d.From != "root@example.edu" || len(d.Rcpts) != 3 || d.Data != testMsg {
+		t.Fatalf("Invalid delivery: %+v", d)
+	}
+
+	// A notification is sent for the permanent failure
+	d = tr.wait(t)
+	if d.From != "" || len(d.Rcpts) != 1 || d.Rcpts[0] != "root@example.edu" {
+		t.Fatalf("Invalid notification delivery: %+v", d)
+	}
+	for _, s := range []string{
+		"Content-Type: multipart/report; report-type=delivery-status;",
+		"Reporting-MTA: dns; mx.example.edu\r\n",
+		"Original-Envelope-Id: QQ314159\r\n",
+		"Final-Recipient: rfc822; carol@example.org\r\n",
+		"Action: failed\r\n",
+		"Status: 5.1.1\r\n",
+		"Remote-MTA: dns; mx.example.org\r\n",
+		"Diagnostic-Code: smtp; 550 5.1.1 No such user\r\n",
+		"Content-Type: message/rfc822\r\n",
+		"Hey <3\r\n",
+	} {
+		if !strings.Contains(d.Data, s) {
+			t.Errorf("Notification doesn't contain %q:\n%v", s, d.Data)
+		}
+	}
+	if strings.Contains(d.Data, "bob@example.org") {
+		t.Errorf("Notification contains a pending recipient:\n%v", d.Data)
+	}
+
+	msg, err := q.Get(id)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if msg.Attempts != 1 || !msg.NextAttempt.After(time.Now().Add(30*time.Minute)) {
+		t.Errorf("Invalid attempts: %v, next at %v", msg.Attempts, msg.NextAttempt)
+	}
+	statuses := []queue.Status{queue.StatusDelivered, queue.StatusPending, queue.StatusFailed}
+	for i, rcpt := range msg.Recipients {
+		if rcpt.Status != statuses[i] {
+			t.Errorf("Recipient %v has status %v; want %v", rcpt.Addr, rcpt.Status, statuses[i])
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The message is still in the queue after a restart
+	tr = newTransport(nil)
+	q, err = queue.Open(dir, tr)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer q.Close()
+	if l := q.List(); len(l) != 1 || l[0].ID != id || l[0].Opts.EnvelopeID != "QQ314159" {
+		t.Fatalf("Invalid queue after restart: %+v", l)
+	}
+
+	q.RetryInterval = time.Hour
+	q.Start()
+	q.Flush()
+
+	d = tr.wait(t)
+	if len(d.Rcpts) != 1 || d.Rcpts[0] != "bob@example.org" {
+		t.Fatalf("Invalid retried delivery: %+v", d)
+	}
+	waitEmpty(t, q)
+
+	if entries, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Queue directory contains %v files after delivery", len(entries))
+	}
+}
+
+func TestQueue_Expire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-queue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tr := newTransport(map[string]error{
+		"alice@example.org": errTemporary,
+		"bob@example.org":   errTemporary,
+	})
+	q, err := queue.Open(dir, tr)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer q.Close()
+	q.MaxLifetime = time.Nanosecond
+	q.Start()
+
+	rcpts := []smtp.Recipient{
+		{Addr: "alice@example.org"},
+		{
+			Addr: "bob@example.org",
+			Opts: &smtp.RcptOptions{Notify: []smtp.DSNNotify{smtp.DSNNotifyNever}},
+		},
+	}
+	opts := &smtp.MailOptions{Return: smtp.DSNReturnHeaders}
+	if _, err := q.Enqueue("root@example.edu", opts, rcpts, strings.NewReader(testMsg)); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	tr.wait(t)
+
+	d := tr.wait(t)
+	if d.From != "" {
+		t.Fatalf("Invalid notification delivery: %+v", d)
+	}
+	for _, s := range []string{
+		"Final-Recipient: rfc822; alice@example.org\r\n",
+		"Action: failed\r\n",
+		"Status: 4.3.0\r\n",
+		"Content-Type: text/rfc822-headers\r\n",
+		"Subject: Hey\r\n",
+	} {
+		if !strings.Contains(d.Data, s) {
+			t.Errorf("Notification doesn't contain %q:\n%v", s, d.Data)
+		}
+	}
+	for _, s := range []string{"bob@example.org", "Hey <3"} {
+		if strings.Contains(d.Data, s) {
+			t.Errorf("Notification contains %q:\n%v", s, d.Data)
+		}
+	}
+	waitEmpty(t, q)
+}
+
+func TestQueue_Delete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-queue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := queue.Open(dir, newTransport(nil))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer q.Close()
+
+	rcpts := []smtp.Recipient{{Addr: "alice@example.org"}}
+	id, err := q.Enqueue("root@example.edu", nil, rcpts, strings.NewReader(testMsg))
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if l := q.List(); len(l) != 1 || l[0].ID != id {
+		t.Fatalf("Invalid queue: %+v", l)
+	}
+
+	if err := q.Delete(id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := q.Delete(id); err != queue.ErrNotFound {
+		t.Fatalf("Delete returned %v; want ErrNotFound", err)
+	}
+	if _, err := q.Get(id); err != queue.ErrNotFound {
+		t.Fatalf("Get returned %v; want ErrNotFound", err)
+	}
+	if entries, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("Queue directory contains %v files after Delete", len(entries))
+	}
+}
+
+func TestQueue_CloseAborted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-queue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tr := &blockingTransport{started: make(chan struct{}, 1)}
+	q, err := queue.Open(dir, tr)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	q.RetryInterval = time.Hour
+	q.Start()
+
+	rcpts := []smtp.Recipient{{Addr: "alice@example.org"}}
+	id, err := q.Enqueue("root@example.edu", nil, rcpts, strings.NewReader(testMsg))
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	select {
+	case <-tr.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a delivery")
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The aborted delivery is retried right away when the queue is opened
+	// again
+	q, err = queue.Open(dir, newTransport(nil))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer q.Close()
+	msg, err := q.Get(id)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if msg.Attempts != 0 || msg.NextAttempt.After(time.Now()) {
+		t.Errorf("Invalid attempts: %v, next at %v", msg.Attempts, msg.NextAttempt)
+	}
+	if rcpt := msg.Recipients[0]; rcpt.Status != queue.StatusPending || rcpt.Err != nil {
+		t.Errorf("Invalid recipient: %+v", rcpt)
+	}
+}
@@ -0,0 +1,352 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// SCRAM mechanisms, as defined in RFC 5802 and RFC 7677.
+const (
+	SCRAMSHA1   = "SCRAM-SHA-1"
+	SCRAMSHA256 = "SCRAM-SHA-256"
+)
+
+func scramHash(mech string) func() hash.Hash {
+	switch mech {
+	case SCRAMSHA1:
+		return sha1.New
+	case SCRAMSHA256:
+		return sha256.New
+	}
+	return nil
+}
+
+// pbkdf2 derives a key from a password, as defined in RFC 8018 section 5.2.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], block)
+		prf.Write(b[:])
+		u := prf.Sum(nil)
+
+		t := append([]byte(nil), u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+func hmacSum(h func() hash.Hash, key []byte, s string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+func hashSum(h func() hash.Hash, b []byte) []byte {
+	hash := h()
+	hash.Write(b)
+	return hash.Sum(nil)
+}
+
+// scramNonce generates a random nonce.
+func scramNonce() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// scramEscape escapes a SCRAM username, see RFC 5802 section 5.1.
+func scramEscape(s string) string {
+	s = strings.Replace(s, "=", "=3D", -1)
+	return strings.Replace(s, ",", "=2C", -1)
+}
+
+// parseSCRAMAttrs parses a comma-separated list of SCRAM attributes.
+func parseSCRAMAttrs(s string) (map[byte]string, error) {
+	attrs := make(map[byte]string)
+	for _, attr := range strings.Split(s, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, fmt.Errorf("smtp: malformed SCRAM attribute: %q", attr)
+		}
+		attrs[attr[0]] = attr[2:]
+	}
+	return attrs, nil
+}
+
+type scramClient struct {
+	mech     string
+	username string
+	password string
+
+	step            int
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// newSCRAMClient implements the client side of the SCRAM-SHA-1 and
+// SCRAM-SHA-256 mechanisms, without channel binding.
+func newSCRAMClient(mech, username, password string) sasl.Client {
+	return &scramClient{mech: mech, username: username, password: password}
+}
+
+func (a *scramClient) Start() (mech string, ir []byte, err error) {
+	if a.clientNonce == "" {
+		a.clientNonce, err = scramNonce()
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	a.clientFirstBare = "n=" + scramEscape(a.username) + ",r=" + a.clientNonce
+	return a.mech, []byte("n,," + a.clientFirstBare), nil
+}
+
+func (a *scramClient) Next(challenge []byte) ([]byte, error) {
+	a.step++
+	switch a.step {
+	case 1:
+		return a.clientFinal(string(challenge))
+	case 2:
+		attrs, err := parseSCRAMAttrs(string(challenge))
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := attrs['e']; ok {
+			return nil, fmt.Errorf("smtp: SCRAM authentication failed: %v", e)
+		}
+		sig, err := base64.StdEncoding.DecodeString(attrs['v'])
+		if err != nil || !hmac.Equal(sig, a.serverSignature) {
+			return nil, errors.New("smtp: invalid SCRAM server signature")
+		}
+		return []byte{}, nil
+	}
+	return nil, sasl.ErrUnexpectedServerChallenge
+}
+
+func (a *scramClient) clientFinal(serverFirst string) ([]byte, error) {
+	attrs, err := parseSCRAMAttrs(serverFirst)
+	if err != nil {
+		return nil, err
+	}
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, a.clientNonce) || len(nonce) == len(a.clientNonce) {
+		return nil, errors.New("smtp: invalid SCRAM server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil {
+		return nil, errors.New("smtp: invalid SCRAM salt")
+	}
+	iter, err := strconv.Atoi(attrs['i'])
+	if err != nil || iter <= 0 {
+		return nil, errors.New("smtp: invalid SCRAM iteration count")
+	}
+
+	h := scramHash(a.mech)
+	saltedPassword := pbkdf2(h, []byte(a.password), salt, iter, h().Size())
+	clientKey := hmacSum(h, saltedPassword, "Client Key")
+	storedKey := hashSum(h, clientKey)
+	serverKey := hmacSum(h, saltedPassword, "Server Key")
+
+	// "biws" is the base64 encoding of the GS2 header "n,,"
+	clientFinal := "c=biws,r=" + nonce
+	authMessage := a.clientFirstBare + "," + serverFirst + "," + clientFinal
+	clientSignature := hmacSum(h, storedKey, authMessage)
+	a.serverSignature = hmacSum(h, serverKey, authMessage)
+
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	clientFinal += ",p=" + base64.StdEncoding.EncodeToString(proof)
+	return []byte(clientFinal), nil
+}
+
+// SCRAMCredentials are the salted credentials of a user for a SCRAM
+// mechanism, as defined in RFC 5802 section 3. They can be stored instead of
+// the password.
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSCRAMCredentials derives the credentials of a password for mech,
+// SCRAMSHA1 or SCRAMSHA256.
+func NewSCRAMCredentials(mech, password string, salt []byte, iterations int) (*SCRAMCredentials, error) {
+	h := scramHash(mech)
+	if h == nil {
+		return nil, fmt.Errorf("smtp: unsupported SCRAM mechanism %q", mech)
+	}
+	saltedPassword := pbkdf2(h, []byte(password), salt, iterations, h().Size())
+	clientKey := hmacSum(h, saltedPassword, "Client Key")
+	return &SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  hashSum(h, clientKey),
+		ServerKey:  hmacSum(h, saltedPassword, "Server Key"),
+	}, nil
+}
+
+type scramServer struct {
+	mech string
+	conn *Conn
+	be   SCRAMBackend
+
+	step            int
+	username        string
+	identity        string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	creds           *SCRAMCredentials
+}
+
+func newSCRAMServer(mech string, conn *Conn, be SCRAMBackend) sasl.Server {
+	return &scramServer{mech: mech, conn: conn, be: be}
+}
+
+func (s *scramServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if response == nil && s.step == 0 {
+		// No initial response
+		return []byte{}, false, nil
+	}
+
+	s.step++
+	switch s.step {
+	case 1:
+		challenge, err = s.handleClientFirst(string(response))
+		return challenge, false, err
+	case 2:
+		challenge, err = s.handleClientFinal(string(response))
+		return challenge, false, err
+	case 3:
+		// The client has received the server signature
+		state := s.conn.State()
+		session, err := s.be.SecretLogin(&state, s.mech, s.identity, s.username)
+		if err != nil {
+			return nil, true, err
+		}
+		s.conn.login(session, s.mech, s.username, s.identity)
+		return nil, true, nil
+	}
+	return nil, false, sasl.ErrUnexpectedClientResponse
+}
+
+func (s *scramServer) handleClientFirst(msg string) ([]byte, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("Invalid SCRAM client message")
+	}
+	switch parts[0] {
+	case "n", "y":
+	default:
+		return nil, errors.New("SCRAM channel binding not supported")
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	attrs, err := parseSCRAMAttrs(s.clientFirstBare)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := attrs['m']; ok {
+		return nil, errors.New("SCRAM extensions not supported")
+	}
+	s.username = scramUnescape(attrs['n'])
+	clientNonce := attrs['r']
+	if s.username == "" || clientNonce == "" {
+		return nil, errors.New("Invalid SCRAM client message")
+	}
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, errors.New("Invalid SCRAM client message")
+		}
+		s.identity = scramUnescape(parts[1][len("a="):])
+	}
+	if err := checkIdentity(s.be, s.identity, s.username); err != nil {
+		return nil, err
+	}
+
+	state := s.conn.State()
+	s.creds, err = s.be.SCRAMSecret(&state, s.mech, s.username)
+	if err != nil {
+		return nil, err
+	}
+
+	serverNonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+	s.nonce = clientNonce + serverNonce
+	s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(s.creds.Salt) +
+		",i=" + strconv.Itoa(s.creds.Iterations)
+	return []byte(s.serverFirst), nil
+}
+
+func (s *scramServer) handleClientFinal(msg string) ([]byte, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, errors.New("Invalid SCRAM client message")
+	}
+	clientFinalWithoutProof := msg[:i]
+	attrs, err := parseSCRAMAttrs(clientFinalWithoutProof)
+	if err != nil {
+		return nil, err
+	}
+	if attrs['c'] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) || attrs['r'] != s.nonce {
+		return nil, errors.New("Invalid SCRAM client message")
+	}
+	proof, err := base64.StdEncoding.DecodeString(msg[i+len(",p="):])
+	if err != nil {
+		return nil, errors.New("Invalid SCRAM client proof")
+	}
+
+	h := scramHash(s.mech)
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + clientFinalWithoutProof
+	clientSignature := hmacSum(h, s.creds.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, ErrAuthFailed
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range clientKey {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	if !hmac.Equal(hashSum(h, clientKey), s.creds.StoredKey) {
+		return nil, ErrAuthFailed
+	}
+
+	serverSignature := hmacSum(h, s.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// scramUnescape unescapes a SCRAM username, see RFC 5802 section 5.1.
+func scramUnescape(s string) string {
+	s = strings.Replace(s, "=2C", ",", -1)
+	return strings.Replace(s, "=3D", "=", -1)
+}
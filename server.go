@@ -1,6 +1,7 @@
 package smtp
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -8,7 +9,10 @@ import (
 	"log"
 	"net"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -17,9 +21,38 @@ import (
 
 var errTCPAndLMTP = errors.New("smtp: cannot start LMTP server listening on a TCP socket")
 
+// ErrServerClosed is returned by Close and Shutdown when the server has
+// already been closed.
+var ErrServerClosed = errors.New("smtp: server already closed")
+
+// shutdownPollInterval is how often Shutdown checks whether all connections
+// have been closed.
+const shutdownPollInterval = 100 * time.Millisecond
+
 // A function that creates SASL servers.
 type SaslServerFactory func(conn *Conn) sasl.Server
 
+// A function that returns the EHLO keyword line of an extension for a
+// connection, e.g. "MT-PRIORITY MIXER". If it returns an empty string, the
+// extension isn't advertised on this connection.
+type CapabilityFunc func(conn *Conn) string
+
+// A function that parses the value of a MAIL or RCPT parameter. The returned
+// value is stored in the Extensions field of the command options. If an
+// error is returned, the command is rejected; an *SMTPError can be used to
+// control the reply.
+type ParamFunc func(conn *Conn, value string) (string, error)
+
+// A function that handles a command registered with Server.RegisterCommand.
+// session is nil if the client hasn't logged in yet.
+//
+// If nil is returned, the handler must have written a reply with
+// Conn.WriteResponse. Otherwise, the error is sent to the client; an
+// *SMTPError can be used to control the reply. Syntax errors, i.e. errors
+// other than *SMTPError and *SMTPError with code 500 or 501, count toward the
+// protocol error threshold.
+type CommandHandler func(conn *Conn, arg string, session Session) error
+
 // Logger interface is used by Server to report unexpected internal errors.
 type Logger interface {
 	Printf(c *Conn, format string, v ...interface{})
@@ -71,16 +104,47 @@ type Server struct {
 	// Should be used only if backend supports it.
 	EnableBINARYMIME bool
 
+	// If set, connections from ProxyProtocol.TrustedNetworks are expected to
+	// start with a PROXY protocol header. The addresses it carries are
+	// reported in ConnectionState.
+	//
+	// When using Serve, the listener must not be a TLS listener, since the
+	// PROXY header is sent before the TLS handshake. ListenAndServeTLS
+	// handles this case.
+	ProxyProtocol *ProxyProtocol
+
+	// Advertise DSN (RFC 3461) capability.
+	// Should be used only if backend supports it.
+	EnableDSN bool
+
+	// Advertise XCLIENT and XFORWARD (Postfix extensions) to trusted peers.
+	// These commands let a front-end proxy pass the attributes of the
+	// original client.
+	EnableXCLIENT  bool
+	EnableXFORWARD bool
+	// TrustedPeer reports whether the peer at addr may use XCLIENT and
+	// XFORWARD. If nil, no peer is trusted.
+	TrustedPeer func(addr net.Addr) bool
+
 	// If set, the AUTH command will not be advertised and authentication
 	// attempts will be rejected. This setting overrides AllowInsecureAuth.
 	AuthDisabled bool
 
+	// Advertise the obsolete LOGIN mechanism, for legacy clients which don't
+	// support PLAIN. Credentials are checked with Backend.Login.
+	EnableLOGIN bool
+
 	// The server backend.
 	Backend Backend
 
-	caps  []string
-	auths map[string]SaslServerFactory
-	done  chan struct{}
+	caps         []string
+	auths        map[string]SaslServerFactory
+	extCaps      map[string]CapabilityFunc
+	mailParams   map[string]ParamFunc
+	rcptParams   map[string]ParamFunc
+	commands     map[string]CommandHandler
+	done         chan struct{}
+	shuttingDown int32
 
 	locker    sync.Mutex
 	listeners []net.Listener
@@ -99,28 +163,32 @@ func NewServer(be Backend) *Server {
 		caps:     []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES", "CHUNKING"},
 		auths: map[string]SaslServerFactory{
 			sasl.Plain: func(conn *Conn) sasl.Server {
-				return sasl.NewPlainServer(func(identity, username, password string) error {
-					if identity != "" && identity != username {
-						return errors.New("Identities not supported")
-					}
-
-					state := conn.State()
-					session, err := be.Login(&state, username, password)
-					if err != nil {
-						return err
-					}
-
-					conn.SetSession(session)
-					return nil
-				})
+				return newPlainServer(conn, conn.server.Backend)
 			},
 		},
-		conns: make(map[*Conn]struct{}),
+		extCaps:    make(map[string]CapabilityFunc),
+		mailParams: make(map[string]ParamFunc),
+		rcptParams: make(map[string]ParamFunc),
+		commands:   make(map[string]CommandHandler),
+		conns:      make(map[*Conn]struct{}),
 	}
 }
 
 // Serve accepts incoming connections on the Listener l.
 func (s *Server) Serve(l net.Listener) error {
+	return s.serve(s.proxyListener(l), nil)
+}
+
+func (s *Server) proxyListener(l net.Listener) net.Listener {
+	if s.ProxyProtocol == nil {
+		return l
+	}
+	return &proxyListener{Listener: l, proxy: s.ProxyProtocol}
+}
+
+// serve accepts connections on l. If tlsConfig is not nil, connections are
+// wrapped in TLS.
+func (s *Server) serve(l net.Listener, tlsConfig *tls.Config) error {
 	s.locker.Lock()
 	s.listeners = append(s.listeners, l)
 	s.locker.Unlock()
@@ -151,8 +219,14 @@ func (s *Server) Serve(l net.Listener) error {
 			}
 			return err
 		}
+		pc, _ := c.(*proxyConn)
+		if tlsConfig != nil {
+			c = tls.Server(c, tlsConfig)
+		}
+
 		go func() {
 			conn := newConn(c, s)
+			conn.proxy = pc
 			err := s.handleConn(conn)
 			if err != nil {
 				s.ErrorLog.Printf(conn, "handler error: %w", err)
@@ -174,6 +248,16 @@ func (s *Server) handleConn(c *Conn) error {
 		s.locker.Unlock()
 	}()
 
+	if pc := c.proxy; pc != nil {
+		if err := pc.readHeader(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			s.ErrorLog.Printf(c, "PROXY header error: %w", err)
+			return err
+		}
+	}
+
 	if tlsConn, ok := c.conn.(*tls.Conn); ok {
 		if d := s.ReadTimeout; d != 0 {
 			c.conn.SetReadDeadline(time.Now().Add(d))
@@ -194,10 +278,21 @@ func (s *Server) handleConn(c *Conn) error {
 		}
 	}
 
-	c.greet()
+	if !c.greet() {
+		return nil
+	}
 
 	for {
-		line, err := c.ReadLine()
+		line, err := c.readCommand()
+		if c.ctx.Err() != nil {
+			// The connection was closed by the last command, don't handle
+			// commands which were already buffered
+			return nil
+		}
+		if s.isShuttingDown() && !c.inTransfer() {
+			c.WriteResponse(421, EnhancedCode{4, 3, 2}, "Service shutting down")
+			return nil
+		}
 		if err == nil {
 			cmd, arg, err := parseCmd(line)
 			if err != nil {
@@ -284,12 +379,12 @@ func (s *Server) ListenAndServeTLS() error {
 		addr = ":smtps"
 	}
 
-	l, err := tls.Listen("tcp", addr, s.TLSConfig)
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	return s.Serve(l)
+	return s.serve(s.proxyListener(l), s.TLSConfig)
 }
 
 // Close immediately closes all active listeners and connections.
@@ -297,9 +392,69 @@ func (s *Server) ListenAndServeTLS() error {
 // Close returns any error returned from closing the server's underlying
 // listener(s).
 func (s *Server) Close() error {
+	err := s.closeListeners()
+
+	s.locker.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.locker.Unlock()
+
+	return err
+}
+
+// Shutdown gracefully shuts down the server without interrupting message
+// transfers. It closes all active listeners, then replies with 421 to the
+// next command of every connection which isn't transferring a message and
+// waits for all connections to terminate. Connections blocked waiting for a
+// command are answered right away.
+//
+// If ctx expires before all connections are closed, the remaining ones are
+// closed forcibly and the context's error is returned. Otherwise, Shutdown
+// returns any error returned from closing the server's underlying
+// listener(s).
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+
+	err := s.closeListeners()
+
+	s.locker.Lock()
+	for conn := range s.conns {
+		conn.interruptIdle()
+	}
+	s.locker.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.locker.Lock()
+		n := len(s.conns)
+		s.locker.Unlock()
+		if n == 0 {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			s.locker.Lock()
+			for conn := range s.conns {
+				conn.Close()
+			}
+			s.locker.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) isShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) != 0
+}
+
+func (s *Server) closeListeners() error {
 	select {
 	case <-s.done:
-		return errors.New("smtp: server already closed")
+		return ErrServerClosed
 	default:
 		close(s.done)
 	}
@@ -311,15 +466,81 @@ func (s *Server) Close() error {
 			err = lerr
 		}
 	}
-
-	for conn := range s.conns {
-		conn.Close()
-	}
 	s.locker.Unlock()
 
 	return err
 }
 
+// authMechanisms returns the names of the SASL mechanisms available on a
+// connection, sorted by name. The built-in mechanisms are available when the
+// backend implements the matching interface.
+func (s *Server) authMechanisms(conn *Conn) []string {
+	var names []string
+	for name := range s.auths {
+		names = append(names, name)
+	}
+	for _, name := range []string{sasl.Login, CRAMMD5, SCRAMSHA1, SCRAMSHA256, sasl.OAuthBearer, XOAuth2, sasl.External} {
+		if _, ok := s.auths[name]; !ok && s.builtinAuth(conn, name) != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// authFactory returns the SASL server factory of a mechanism, or nil if the
+// mechanism isn't available on a connection.
+func (s *Server) authFactory(conn *Conn, name string) SaslServerFactory {
+	if f, ok := s.auths[name]; ok {
+		return f
+	}
+	return s.builtinAuth(conn, name)
+}
+
+func (s *Server) builtinAuth(conn *Conn, name string) SaslServerFactory {
+	switch name {
+	case sasl.Login:
+		if s.EnableLOGIN {
+			return func(conn *Conn) sasl.Server {
+				return newLoginServer(conn, s.Backend)
+			}
+		}
+	case CRAMMD5:
+		if be, ok := s.Backend.(CRAMMD5Backend); ok {
+			return func(conn *Conn) sasl.Server {
+				return newCRAMMD5Server(conn, be)
+			}
+		}
+	case SCRAMSHA1, SCRAMSHA256:
+		if be, ok := s.Backend.(SCRAMBackend); ok {
+			return func(conn *Conn) sasl.Server {
+				return newSCRAMServer(name, conn, be)
+			}
+		}
+	case sasl.OAuthBearer:
+		if be, ok := s.Backend.(TokenBackend); ok {
+			return func(conn *Conn) sasl.Server {
+				return newOAuthBearerServer(conn, be)
+			}
+		}
+	case XOAuth2:
+		if be, ok := s.Backend.(TokenBackend); ok {
+			return func(conn *Conn) sasl.Server {
+				return newXOAuth2Server(conn, be)
+			}
+		}
+	case sasl.External:
+		// Only clients with a verified certificate can use EXTERNAL
+		be, ok := s.Backend.(ExternalBackend)
+		if tlsState, isTLS := conn.TLSConnectionState(); ok && isTLS && len(tlsState.VerifiedChains) > 0 {
+			return func(conn *Conn) sasl.Server {
+				return newExternalServer(conn, be)
+			}
+		}
+	}
+	return nil
+}
+
 // EnableAuth enables an authentication mechanism on this server.
 //
 // This function should not be called directly, it must only be used by
@@ -328,6 +549,43 @@ func (s *Server) EnableAuth(name string, f SaslServerFactory) {
 	s.auths[name] = f
 }
 
+// EnableCapability advertises an EHLO keyword on this server. If f is nil,
+// name is always advertised as is. Otherwise, f is called for each EHLO
+// command and its result is advertised instead. Registered keywords are
+// advertised after the built-in ones, sorted by name.
+func (s *Server) EnableCapability(name string, f CapabilityFunc) {
+	s.extCaps[strings.ToUpper(name)] = f
+}
+
+// EnableMailParam accepts a MAIL FROM parameter on this server. f parses the
+// value sent by the client and its result is stored in
+// MailOptions.Extensions. Built-in parameters, such as SIZE or BODY, cannot be
+// overridden. The matching EHLO keyword is not advertised automatically, see
+// EnableCapability.
+func (s *Server) EnableMailParam(name string, f ParamFunc) {
+	s.mailParams[strings.ToUpper(name)] = f
+}
+
+// EnableRcptParam accepts a RCPT TO parameter on this server. f parses the
+// value sent by the client and its result is stored in
+// RcptOptions.Extensions, which is only passed to sessions implementing
+// RcptOptionsSession or ContextSession. Built-in parameters, such as NOTIFY
+// or ORCPT, cannot be overridden.
+func (s *Server) EnableRcptParam(name string, f ParamFunc) {
+	s.rcptParams[strings.ToUpper(name)] = f
+}
+
+// RegisterCommand registers a handler for a command on this server, e.g.
+// ETRN or a vendor-specific X-command. Command names are case-insensitive.
+// Commands implemented by the server cannot be overridden, with the exception
+// of SEND, SOML, SAML, EXPN, HELP and TURN.
+//
+// Commands must be registered before the server starts accepting
+// connections.
+func (s *Server) RegisterCommand(name string, h CommandHandler) {
+	s.commands[strings.ToUpper(name)] = h
+}
+
 // ForEachConn iterates through all opened connections.
 func (s *Server) ForEachConn(f func(*Conn)) {
 	s.locker.Lock()
@@ -3,14 +3,31 @@ package smtp_test
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 )
 
@@ -19,9 +36,14 @@ type message struct {
 	To   []string
 	Data []byte
 	Opts *smtp.MailOptions
+
+	RcptOpts []*smtp.RcptOptions
 }
 
 type backend struct {
+	// Protects messages and anonmsgs
+	mu sync.Mutex
+
 	messages []*message
 	anonmsgs []*message
 
@@ -43,9 +65,26 @@ type backend struct {
 
 	panicOnMail bool
 	userErr     error
+
+	implementContext     bool
+	implementRcptOptions bool
+	implementVerify      bool
+	// Context passed to the last MailContext call.
+	mailCtx context.Context
+
+	// Connection state passed to the last login.
+	state *smtp.ConnectionState
+
+	// Reply to Connect calls.
+	banner     string
+	connectErr error
+	xclientErr error
+
+	hello func(domain string, caps []string) ([]string, error)
 }
 
-func (be *backend) Login(_ *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+func (be *backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	be.state = state
 	if be.userErr != nil {
 		return &session{}, be.userErr
 	}
@@ -57,11 +96,35 @@ func (be *backend) Login(_ *smtp.ConnectionState, username, password string) (sm
 	if be.implementLMTPData {
 		return &lmtpSession{&session{backend: be}}, nil
 	}
+	if be.implementContext {
+		return &contextSession{&session{backend: be}}, nil
+	}
+	if be.implementRcptOptions {
+		return &rcptOptionsSession{&session{backend: be}}, nil
+	}
+	if be.implementVerify {
+		return &verifySession{&session{backend: be}}, nil
+	}
 
 	return &session{backend: be}, nil
 }
 
-func (be *backend) AnonymousLogin(_ *smtp.ConnectionState) (smtp.Session, error) {
+func (be *backend) Connect(state *smtp.ConnectionState) (string, error) {
+	if state.XClient != nil && be.xclientErr != nil {
+		return "", be.xclientErr
+	}
+	return be.banner, be.connectErr
+}
+
+func (be *backend) Hello(state *smtp.ConnectionState, domain string, caps []string) ([]string, error) {
+	if be.hello == nil {
+		return caps, nil
+	}
+	return be.hello(domain, caps)
+}
+
+func (be *backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	be.state = state
 	if be.userErr != nil {
 		return &session{}, be.userErr
 	}
@@ -69,6 +132,12 @@ func (be *backend) AnonymousLogin(_ *smtp.ConnectionState) (smtp.Session, error)
 	if be.implementLMTPData {
 		return &lmtpSession{&session{backend: be, anonymous: true}}, nil
 	}
+	if be.implementContext {
+		return &contextSession{&session{backend: be, anonymous: true}}, nil
+	}
+	if be.implementRcptOptions {
+		return &rcptOptionsSession{&session{backend: be, anonymous: true}}, nil
+	}
 
 	return &session{backend: be, anonymous: true}, nil
 }
@@ -77,6 +146,29 @@ type lmtpSession struct {
 	*session
 }
 
+type contextSession struct {
+	*session
+}
+
+func (s *contextSession) MailContext(ctx context.Context, from string, opts *smtp.MailOptions) error {
+	s.backend.mailCtx = ctx
+	return s.Mail(from, opts)
+}
+
+func (s *contextSession) RcptContext(ctx context.Context, to string, opts *smtp.RcptOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Rcpt(to)
+}
+
+func (s *contextSession) DataContext(ctx context.Context, r io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Data(r)
+}
+
 type session struct {
 	backend   *backend
 	anonymous bool
@@ -84,6 +176,42 @@ type session struct {
 	msg *message
 }
 
+type rcptOptionsSession struct {
+	*session
+}
+
+func (s *rcptOptionsSession) RcptWithOptions(to string, opts *smtp.RcptOptions) error {
+	s.msg.RcptOpts = append(s.msg.RcptOpts, opts)
+	return s.Rcpt(to)
+}
+
+type verifySession struct {
+	*session
+}
+
+func (s *verifySession) Verify(addr string) ([]string, error) {
+	switch addr {
+	case "root":
+		return []string{"Root <root@nsa.gov>"}, nil
+	case "admin":
+		return nil, &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 4},
+			Message:      "User ambiguous",
+		}
+	case "db":
+		return nil, errors.New("database connection lost")
+	}
+	return nil, nil
+}
+
+func (s *verifySession) Expand(list string) ([]string, error) {
+	if list != "staff" {
+		return nil, nil
+	}
+	return []string{"Root <root@nsa.gov>", "<admin@nsa.gov>"}, nil
+}
+
 func (s *session) Reset() {
 	s.msg = &message{}
 }
@@ -128,11 +256,13 @@ func (s *session) Data(r io.Reader) error {
 		return err
 	} else {
 		s.msg.Data = b
+		s.backend.mu.Lock()
 		if s.anonymous {
 			s.backend.anonmsgs = append(s.backend.anonmsgs, s.msg)
 		} else {
 			s.backend.messages = append(s.backend.messages, s.msg)
 		}
+		s.backend.mu.Unlock()
 		if s.backend.dataErrors != nil {
 			s.backend.dataErrors <- nil
 		}
@@ -330,8 +460,8 @@ func TestServer_helo(t *testing.T) {
 	}
 }
 
-func testServerAuthenticated(t *testing.T) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
-	be, s, c, scanner, caps := testServerEhlo(t)
+func testServerAuthenticated(t *testing.T, fn ...serverConfigureFunc) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
+	be, s, c, scanner, caps := testServerEhlo(t, fn...)
 
 	if _, ok := caps["AUTH PLAIN"]; !ok {
 		t.Fatal("AUTH PLAIN capability is missing when auth is enabled")
@@ -469,6 +599,19 @@ func TestServerSMTPUTF8_Disabled(t *testing.T) {
 	}
 }
 
+func TestServerREQUIRETLS_Cleartext(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	s.EnableREQUIRETLS = true
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> REQUIRETLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "530 5.7.10 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
 func TestServer8BITMIME(t *testing.T) {
 	_, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -547,6 +690,67 @@ func TestServerEmptyTo(t *testing.T) {
 	}
 }
 
+func TestServerRcptPath(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	for _, path := range []string{"root@gchq.gov.uk>>", "<root@gchq.gov.uk", "<<root@gchq.gov.uk>", "<>", "<@relay.example.org>"} {
+		io.WriteString(c, "RCPT TO:"+path+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "501 ") {
+			t.Fatalf("Invalid RCPT response for %q: %v", path, scanner.Text())
+		}
+	}
+
+	for _, path := range []string{"<root@gchq.gov.uk>", " <root@gchq.gov.uk>", "<@relay.example.org:root@gchq.gov.uk>", "root@gchq.gov.uk"} {
+		io.WriteString(c, "RCPT TO:"+path+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatalf("Invalid RCPT response for %q: %v", path, scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	for i, to := range be.messages[0].To {
+		if to != "root@gchq.gov.uk" {
+			t.Errorf("Invalid recipient #%v: %v", i, to)
+		}
+	}
+}
+
+func TestServerUnknownRcptParam(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> FOO=BAR\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "555 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+}
+
 func TestServer(t *testing.T) {
 	be, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -1243,3 +1447,1255 @@ func TestServer_TooLongCommand(t *testing.T) {
 		t.Fatal("Invalid too long MAIL response:", scanner.Text())
 	}
 }
+
+func TestServer_Shutdown(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	io.WriteString(c, "Hey <3\r\n")
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+
+	// Let Shutdown start before finishing the transfer.
+	time.Sleep(50 * time.Millisecond)
+
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "421 4.3.2 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	if err := <-shutdownErr; err != nil {
+		t.Fatal("Unexpected Shutdown error:", err)
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+}
+
+func TestServer_Shutdown_Idle(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t)
+	defer c.Close()
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal("Unexpected Shutdown error:", err)
+	}
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "421 4.3.2 ") {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+}
+
+func TestServer_Shutdown_Chunking(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	io.WriteString(c, "BDAT 8 LAST\r\n")
+	io.WriteString(c, "Hey :3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "421 4.3.2 ") {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+
+	if err := <-shutdownErr; err != nil {
+		t.Fatal("Unexpected Shutdown error:", err)
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+}
+
+func TestServer_Shutdown_Timeout(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer c.Close()
+	be.dataErrors = make(chan error, 1)
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Unexpected Shutdown error:", err)
+	}
+
+	if err := <-be.dataErrors; err == nil {
+		t.Fatal("Expected the transfer to be interrupted")
+	}
+}
+
+func TestServer_Context(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.Backend.(*backend).implementContext = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	ctx := be.mailCtx
+	if ctx == nil {
+		t.Fatal("MailContext was not called")
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Context cancelled too early:", ctx.Err())
+	}
+
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if ctx.Err() != context.Canceled {
+		t.Fatal("Context not cancelled on RSET:", ctx.Err())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+	ctx = be.mailCtx
+
+	s.Close()
+	if ctx.Err() != context.Canceled {
+		t.Fatal("Context not cancelled on Server.Close:", ctx.Err())
+	}
+}
+
+func testServerProxy(t *testing.T, trusted string, header []byte) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
+	be, s, c, scanner = testServer(t, func(s *smtp.Server) {
+		_, n, err := net.ParseCIDR(trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ProxyProtocol = &smtp.ProxyProtocol{TrustedNetworks: []*net.IPNet{n}}
+	})
+
+	c.Write(header)
+
+	scanner.Scan()
+	if scanner.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+
+	return
+}
+
+func TestServer_ProxyV1(t *testing.T) {
+	be, s, c, scanner := testServerProxy(t, "127.0.0.0/8", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 25\r\n"))
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	if addr := be.state.RemoteAddr.String(); addr != "192.0.2.1:12345" {
+		t.Fatal("Invalid remote address:", addr)
+	}
+	if addr := be.state.LocalAddr.String(); addr != "198.51.100.1:25" {
+		t.Fatal("Invalid local address:", addr)
+	}
+	if be.state.Proxy == nil || be.state.Proxy.Version != 1 {
+		t.Fatal("Invalid PROXY header:", be.state.Proxy)
+	}
+}
+
+func TestServer_ProxyV2(t *testing.T) {
+	var sslTLV bytes.Buffer
+	sslTLV.WriteByte(0x01)           // client connected over TLS
+	sslTLV.Write([]byte{0, 0, 0, 0}) // verified
+	sslTLV.Write([]byte{0x21, 0, 7}) // version
+	sslTLV.WriteString("TLSv1.3")
+
+	var payload bytes.Buffer
+	payload.Write([]byte{192, 0, 2, 1, 198, 51, 100, 1})
+	binary.Write(&payload, binary.BigEndian, uint16(12345))
+	binary.Write(&payload, binary.BigEndian, uint16(25))
+	payload.Write([]byte{0x02, 0, 11})
+	payload.WriteString("example.org")
+	payload.WriteByte(0x20)
+	binary.Write(&payload, binary.BigEndian, uint16(sslTLV.Len()))
+	payload.Write(sslTLV.Bytes())
+
+	var header bytes.Buffer
+	header.WriteString("\r\n\r\n\x00\r\nQUIT\n")
+	header.Write([]byte{0x21, 0x11}) // v2 PROXY, TCP over IPv4
+	binary.Write(&header, binary.BigEndian, uint16(payload.Len()))
+	header.Write(payload.Bytes())
+
+	be, s, c, scanner := testServerProxy(t, "127.0.0.0/8", header.Bytes())
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	if addr := be.state.RemoteAddr.String(); addr != "192.0.2.1:12345" {
+		t.Fatal("Invalid remote address:", addr)
+	}
+	if addr := be.state.LocalAddr.String(); addr != "198.51.100.1:25" {
+		t.Fatal("Invalid local address:", addr)
+	}
+	if authority := be.state.Proxy.Authority(); authority != "example.org" {
+		t.Fatal("Invalid authority:", authority)
+	}
+	ssl, err := be.state.Proxy.SSL()
+	if err != nil {
+		t.Fatal("Failed to parse SSL TLV:", err)
+	}
+	if ssl == nil || !ssl.Verified || ssl.Version != "TLSv1.3" {
+		t.Fatal("Invalid SSL TLV:", ssl)
+	}
+}
+
+func TestServer_ProxyUntrusted(t *testing.T) {
+	_, n, _ := net.ParseCIDR("192.0.2.0/24")
+	tests := []struct {
+		name    string
+		trusted []*net.IPNet
+	}{
+		{"other network", []*net.IPNet{n}},
+		// Nobody is trusted by default
+		{"no trusted network", nil},
+	}
+	for _, test := range tests {
+		be, s, c, scanner := testServer(t, func(s *smtp.Server) {
+			s.ProxyProtocol = &smtp.ProxyProtocol{TrustedNetworks: test.trusted}
+		})
+
+		scanner.Scan()
+		if scanner.Text() != "220 localhost ESMTP Service Ready" {
+			t.Fatalf("%v: invalid greeting: %v", test.name, scanner.Text())
+		}
+
+		io.WriteString(c, "PROXY TCP4 192.0.2.1 198.51.100.1 12345 25\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "50") {
+			t.Fatalf("%v: invalid PROXY response: %v", test.name, scanner.Text())
+		}
+
+		io.WriteString(c, "HELO localhost\r\n")
+		scanner.Scan()
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatalf("%v: invalid MAIL response: %v", test.name, scanner.Text())
+		}
+		if be.state.Proxy != nil {
+			t.Fatalf("%v: unexpected PROXY header: %v", test.name, be.state.Proxy)
+		}
+		if ip := be.state.RemoteAddr.(*net.TCPAddr).IP; !ip.IsLoopback() {
+			t.Fatalf("%v: invalid remote address: %v", test.name, ip)
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServer_XCLIENT(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableXCLIENT = true
+		s.TrustedPeer = func(addr net.Addr) bool {
+			return addr.(*net.TCPAddr).IP.IsLoopback()
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["XCLIENT NAME ADDR PORT PROTO HELO LOGIN DESTADDR DESTPORT"] {
+		t.Fatal("Missing XCLIENT capability:", caps)
+	}
+
+	io.WriteString(c, "XCLIENT ADDR=192.0.2.1 PORT=4242 NAME=mail.example.org HELO=mx.example.org\r\n")
+	scanner.Scan()
+	if scanner.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatal("Invalid XCLIENT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "XCLIENT LOGIN=[UNAVAILABLE] DESTADDR=IPV6:2001:db8::1 DESTPORT=25\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid XCLIENT response:", scanner.Text())
+	}
+
+	// EHLO must be sent again after the greeting
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "250 ") {
+	}
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	if addr := be.state.RemoteAddr.String(); addr != "192.0.2.1:4242" {
+		t.Fatal("Invalid remote address:", addr)
+	}
+	if addr := be.state.LocalAddr.String(); addr != "[2001:db8::1]:25" {
+		t.Fatal("Invalid local address:", addr)
+	}
+	if be.state.Hostname != "mx.example.org" {
+		t.Fatal("Invalid hostname:", be.state.Hostname)
+	}
+	if be.state.XClient.Name != "mail.example.org" {
+		t.Fatal("Invalid client name:", be.state.XClient.Name)
+	}
+
+	io.WriteString(c, "XCLIENT ADDR=192.0.2.2\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "503 ") {
+		t.Fatal("Invalid XCLIENT response:", scanner.Text())
+	}
+}
+
+func TestServer_XCLIENT_ConnectReject(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableXCLIENT = true
+		s.TrustedPeer = func(addr net.Addr) bool { return true }
+		s.Backend.(*backend).xclientErr = &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Client host rejected",
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// Commands pipelined after a rejected XCLIENT are not processed
+	io.WriteString(c, "XCLIENT ADDR=192.0.2.1\r\nMAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "554 5.7.1 Client host rejected" {
+		t.Fatal("Invalid XCLIENT response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_XCLIENT_Untrusted(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableXCLIENT = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for cap := range caps {
+		if strings.HasPrefix(cap, "XCLIENT") {
+			t.Fatal("XCLIENT capability advertised to untrusted peer")
+		}
+	}
+
+	io.WriteString(c, "XCLIENT ADDR=192.0.2.1\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "550 ") {
+		t.Fatal("Invalid XCLIENT response:", scanner.Text())
+	}
+}
+
+func TestServer_XFORWARD(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableXFORWARD = true
+		s.TrustedPeer = func(addr net.Addr) bool { return true }
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["XFORWARD NAME ADDR PORT PROTO HELO IDENT SOURCE"] {
+		t.Fatal("Missing XFORWARD capability:", caps)
+	}
+
+	io.WriteString(c, "XFORWARD ADDR=192.0.2.1 NAME=mail.example.org SOURCE=REMOTE\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid XFORWARD response:", scanner.Text())
+	}
+
+	io.WriteString(c, "XFORWARD BOGUS=1\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid XFORWARD response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	xf := be.state.XForward
+	if xf == nil || !xf.Addr.Equal(net.ParseIP("192.0.2.1")) || xf.Name != "mail.example.org" || xf.Source != "REMOTE" {
+		t.Fatal("Invalid XFORWARD attributes:", xf)
+	}
+	if ip := be.state.RemoteAddr.(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Fatal("XFORWARD changed the remote address:", ip)
+	}
+}
+
+func TestServer_DSN(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableDSN = true
+		s.Backend.(*backend).implementRcptOptions = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["DSN"] {
+		t.Fatal("Missing DSN capability")
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> RET=HDRS ENVID=QQ314159+2B1\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> NOTIFY=SUCCESS,DELAY ORCPT=rfc822;root+2Bdsn@gchq.gov.uk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> NOTIFY=NEVER,SUCCESS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	msg := be.anonmsgs[0]
+	if msg.Opts.Return != smtp.DSNReturnHeaders {
+		t.Fatal("Invalid RET value:", msg.Opts.Return)
+	}
+	if msg.Opts.EnvelopeID != "QQ314159+1" {
+		t.Fatal("Invalid ENVID value:", msg.Opts.EnvelopeID)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "root@gchq.gov.uk" {
+		t.Fatal("Invalid mail recipients:", msg.To)
+	}
+	opts := msg.RcptOpts[0]
+	if len(opts.Notify) != 2 || opts.Notify[0] != smtp.DSNNotifySuccess || opts.Notify[1] != smtp.DSNNotifyDelayed {
+		t.Fatal("Invalid NOTIFY value:", opts.Notify)
+	}
+	if opts.OriginalRecipientType != smtp.DSNAddressTypeRFC822 || opts.OriginalRecipient != "root+dsn@gchq.gov.uk" {
+		t.Fatal("Invalid ORCPT value:", opts.OriginalRecipientType, opts.OriginalRecipient)
+	}
+}
+
+func TestServer_DSN_Disabled(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> RET=FULL\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_Extensions(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.Backend.(*backend).implementRcptOptions = true
+		s.EnableCapability("MT-PRIORITY", func(conn *smtp.Conn) string {
+			return "MT-PRIORITY MIXER"
+		})
+		s.EnableCapability("XHIDDEN", func(conn *smtp.Conn) string {
+			return ""
+		})
+		s.EnableCapability("XSTATIC", nil)
+		s.EnableMailParam("MT-PRIORITY", func(conn *smtp.Conn, value string) (string, error) {
+			if _, err := strconv.Atoi(value); err != nil {
+				return "", &smtp.SMTPError{
+					Code:         501,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+					Message:      "Invalid priority",
+				}
+			}
+			return value, nil
+		})
+		s.EnableRcptParam("XFLAG", func(conn *smtp.Conn, value string) (string, error) {
+			return strings.ToLower(value), nil
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["MT-PRIORITY MIXER"] || !caps["XSTATIC"] {
+		t.Fatal("Missing extension capabilities:", caps)
+	}
+	if caps["XHIDDEN"] {
+		t.Fatal("Hidden capability is advertised")
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> MT-PRIORITY=high\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 5.5.4 Invalid priority") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> MT-PRIORITY=3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> XFLAG=YES\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	msg := be.anonmsgs[0]
+	if v := msg.Opts.Extensions["MT-PRIORITY"]; v != "3" {
+		t.Fatal("Invalid MT-PRIORITY value:", v)
+	}
+	if v := msg.RcptOpts[0].Extensions["XFLAG"]; v != "yes" {
+		t.Fatal("Invalid XFLAG value:", v)
+	}
+}
+
+func TestServer_RegisterCommand(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.RegisterCommand("HELP", func(conn *smtp.Conn, arg string, session smtp.Session) error {
+			conn.WriteResponse(214, smtp.EnhancedCode{2, 0, 0}, "See RFC 5321", "Have a nice day")
+			return nil
+		})
+		s.RegisterCommand("XECHO", func(conn *smtp.Conn, arg string, session smtp.Session) error {
+			if session == nil {
+				return errors.New("Missing session")
+			}
+			if arg == "" {
+				return errors.New("Missing argument")
+			}
+			line, err := conn.ReadLine()
+			if err != nil {
+				return err
+			}
+			conn.WriteResponse(250, smtp.EnhancedCode{2, 0, 0}, arg+" "+line)
+			return nil
+		})
+		s.RegisterCommand("ETRN", func(conn *smtp.Conn, arg string, session smtp.Session) error {
+			return &smtp.SMTPError{
+				Code:         458,
+				EnhancedCode: smtp.EnhancedCode{4, 5, 0},
+				Message:      "Unable to queue messages for " + arg,
+			}
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELP\r\n")
+	scanner.Scan()
+	if scanner.Text() != "214-See RFC 5321" {
+		t.Fatal("Invalid HELP response:", scanner.Text())
+	}
+	scanner.Scan()
+	if scanner.Text() != "214 2.0.0 Have a nice day" {
+		t.Fatal("Invalid HELP response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "xecho hello\r\nworld\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 hello world" {
+		t.Fatal("Invalid XECHO response:", scanner.Text())
+	}
+
+	// Negative replies don't count toward the protocol error threshold
+	for i := 0; i < 4; i++ {
+		io.WriteString(c, "ETRN example.org\r\n")
+		scanner.Scan()
+		if scanner.Text() != "458 4.5.0 Unable to queue messages for example.org" {
+			t.Fatal("Invalid ETRN response:", scanner.Text())
+		}
+	}
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	// Syntax errors do
+	for i := 0; i < 4; i++ {
+		io.WriteString(c, "XECHO\r\n")
+		scanner.Scan()
+		if scanner.Text() != "501 5.5.4 Missing argument" {
+			t.Fatal("Invalid XECHO response:", scanner.Text())
+		}
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+}
+
+func TestServer_VRFY(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "VRFY root\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "252 ") {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+
+	io.WriteString(c, "EXPN staff\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid EXPN response:", scanner.Text())
+	}
+}
+
+func TestServer_VRFY_Session(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.Backend.(*backend).implementVerify = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "VRFY root\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.1.5 Root <root@nsa.gov>" {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+
+	io.WriteString(c, "VRFY admin\r\n")
+	scanner.Scan()
+	if scanner.Text() != "553 5.1.4 User ambiguous" {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+
+	io.WriteString(c, "VRFY nobody\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "550 ") {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+
+	// Internal errors aren't sent to the client
+	io.WriteString(c, "VRFY db\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "451 ") || strings.Contains(scanner.Text(), "database") {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+
+	io.WriteString(c, "EXPN staff\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250-Root <root@nsa.gov>" {
+		t.Fatal("Invalid EXPN response:", scanner.Text())
+	}
+	scanner.Scan()
+	if scanner.Text() != "250 2.1.5 <admin@nsa.gov>" {
+		t.Fatal("Invalid EXPN response:", scanner.Text())
+	}
+
+	io.WriteString(c, "EXPN\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid EXPN response:", scanner.Text())
+	}
+}
+
+func TestServer_Connect(t *testing.T) {
+	_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+		s.Backend.(*backend).banner = "localhost ESMTP Postfix"
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner.Scan()
+	if scanner.Text() != "220 localhost ESMTP Postfix" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+}
+
+func TestServer_Connect_Reject(t *testing.T) {
+	_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+		s.Backend.(*backend).connectErr = &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Client host rejected",
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner.Scan()
+	if scanner.Text() != "554 5.7.1 Client host rejected" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_Connect_RejectInternalError(t *testing.T) {
+	_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+		s.Backend.(*backend).connectErr = errors.New("zen.spamhaus.example lookup failed")
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner.Scan()
+	if scanner.Text() != "554 5.7.1 Connection rejected" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_Hello(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.MaxMessageBytes = 1024
+		s.Backend.(*backend).hello = func(domain string, caps []string) ([]string, error) {
+			if domain == "localhost" {
+				return nil, &smtp.SMTPError{
+					Code:         550,
+					EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+					Message:      "You are not me",
+				}
+			}
+			var out []string
+			for _, line := range caps {
+				if strings.HasPrefix(line, "AUTH ") {
+					continue
+				}
+				if strings.HasPrefix(line, "SIZE ") {
+					line = "SIZE 512"
+				}
+				out = append(out, line)
+			}
+			return append(out, "XUNTRUSTED"), nil
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+	if scanner.Text() != "550 5.7.1 You are not me" {
+		t.Fatal("Invalid HELO response:", scanner.Text())
+	}
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	scanner.Scan()
+	if scanner.Text() != "550 5.7.1 You are not me" {
+		t.Fatal("Invalid EHLO response:", scanner.Text())
+	}
+
+	io.WriteString(c, "EHLO mx.example.org\r\n")
+	caps := make(map[string]bool)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "250") {
+			t.Fatal("Invalid EHLO response:", line)
+		}
+		caps[line[4:]] = true
+		if strings.HasPrefix(line, "250 ") {
+			break
+		}
+	}
+	for _, name := range []string{"Hello mx.example.org", "SIZE 512", "XUNTRUSTED"} {
+		if !caps[name] {
+			t.Errorf("Missing capability %q: %v", name, caps)
+		}
+	}
+	if caps["SIZE 1024"] || caps["AUTH PLAIN"] {
+		t.Error("Unexpected capabilities:", caps)
+	}
+
+	io.WriteString(c, "AUTH PLAIN\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	// HELO doesn't bring AUTH back
+	io.WriteString(c, "HELO mx.example.org\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid HELO response:", scanner.Text())
+	}
+	io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+}
+
+// authBackend enables the challenge-response and token mechanisms.
+type authBackend struct {
+	*backend
+}
+
+func (be *authBackend) TokenLogin(state *smtp.ConnectionState, username, token string) (smtp.Session, error) {
+	if username != "username" || token != "token" {
+		return nil, smtp.ErrAuthFailed
+	}
+	return be.Login(state, "username", "password")
+}
+
+// mayActAs reports whether username may act as identity: users may send as
+// the shared mailbox.
+func (be *authBackend) mayActAs(username, identity string) bool {
+	return identity == "" || identity == username || identity == "shared"
+}
+
+func (be *authBackend) AuthzLogin(state *smtp.ConnectionState, mech, identity, username, password string) (smtp.Session, error) {
+	if !be.mayActAs(username, identity) {
+		return nil, smtp.ErrAuthFailed
+	}
+	return be.Login(state, username, password)
+}
+
+func (be *authBackend) SecretLogin(state *smtp.ConnectionState, mech, identity, username string) (smtp.Session, error) {
+	if !be.mayActAs(username, identity) {
+		return nil, smtp.ErrAuthFailed
+	}
+	return be.Login(state, username, "password")
+}
+
+func (be *authBackend) CRAMMD5Secret(state *smtp.ConnectionState, username string) (string, error) {
+	if username != "username" {
+		return "", smtp.ErrAuthFailed
+	}
+	return "password", nil
+}
+
+func (be *authBackend) SCRAMSecret(state *smtp.ConnectionState, mech, username string) (*smtp.SCRAMCredentials, error) {
+	if username != "username" {
+		return nil, smtp.ErrAuthFailed
+	}
+	return smtp.NewSCRAMCredentials(mech, "password", []byte("NaCl"), 4096)
+}
+
+// noAuthzBackend enables the same mechanisms as authBackend, except that it
+// doesn't implement AuthzBackend.
+type noAuthzBackend struct {
+	*backend
+	auth *authBackend
+}
+
+func newNoAuthzBackend(be *backend) *noAuthzBackend {
+	return &noAuthzBackend{be, &authBackend{be}}
+}
+
+func (be *noAuthzBackend) SecretLogin(state *smtp.ConnectionState, mech, identity, username string) (smtp.Session, error) {
+	return be.auth.SecretLogin(state, mech, identity, username)
+}
+
+func (be *noAuthzBackend) SCRAMSecret(state *smtp.ConnectionState, mech, username string) (*smtp.SCRAMCredentials, error) {
+	return be.auth.SCRAMSecret(state, mech, username)
+}
+
+func (be *noAuthzBackend) ExternalLogin(state *smtp.ConnectionState, identity string, cert *x509.Certificate) (smtp.Session, error) {
+	return be.auth.ExternalLogin(state, identity, cert)
+}
+
+type cramMD5Client struct {
+	username, password string
+}
+
+func (a *cramMD5Client) Start() (string, []byte, error) {
+	return "CRAM-MD5", nil, nil
+}
+
+func (a *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	mac := hmac.New(md5.New, []byte(a.password))
+	mac.Write(challenge)
+	return []byte(a.username + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+type xoauth2Client struct {
+	username, token string
+}
+
+func (a *xoauth2Client) Start() (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+func TestServerAuthMechanisms(t *testing.T) {
+	_, s, c, _, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.Backend = &authBackend{s.Backend.(*backend)}
+		s.EnableLOGIN = true
+	})
+	defer s.Close()
+	addr := c.RemoteAddr().String()
+	c.Close()
+
+	if !caps["AUTH CRAM-MD5 LOGIN OAUTHBEARER PLAIN SCRAM-SHA-1 SCRAM-SHA-256 XOAUTH2"] {
+		t.Fatalf("Invalid AUTH capability: %v", caps)
+	}
+
+	tests := []struct {
+		name string
+		auth func(c *smtp.Client) error
+		ok   bool
+	}{
+		{"SCRAM", func(c *smtp.Client) error {
+			return c.Authenticate(&smtp.Credentials{Username: "username", Password: "password", AllowInsecure: true})
+		}, true},
+		{"SCRAM invalid password", func(c *smtp.Client) error {
+			return c.Authenticate(&smtp.Credentials{Username: "username", Password: "wrong", AllowInsecure: true})
+		}, false},
+		{"CRAM-MD5", func(c *smtp.Client) error {
+			return c.Auth(&cramMD5Client{"username", "password"})
+		}, true},
+		{"CRAM-MD5 invalid password", func(c *smtp.Client) error {
+			return c.Auth(&cramMD5Client{"username", "wrong"})
+		}, false},
+		{"LOGIN", func(c *smtp.Client) error {
+			return c.Auth(sasl.NewLoginClient("username", "password"))
+		}, true},
+		{"OAUTHBEARER", func(c *smtp.Client) error {
+			return c.Authenticate(&smtp.Credentials{Username: "username", Token: "token", AllowInsecure: true})
+		}, true},
+		{"OAUTHBEARER invalid token", func(c *smtp.Client) error {
+			return c.Authenticate(&smtp.Credentials{Username: "username", Token: "wrong", AllowInsecure: true})
+		}, false},
+		{"XOAUTH2", func(c *smtp.Client) error {
+			return c.Auth(&xoauth2Client{"username", "token"})
+		}, true},
+		{"XOAUTH2 invalid token", func(c *smtp.Client) error {
+			return c.Auth(&xoauth2Client{"username", "wrong"})
+		}, false},
+	}
+	for _, test := range tests {
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+
+		err = test.auth(c)
+		if test.ok && err != nil {
+			t.Errorf("%v: authentication failed: %v", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%v: authentication succeeded", test.name)
+		}
+
+		// The connection is still usable
+		if err := c.Noop(); err != nil {
+			t.Errorf("%v: NOOP failed: %v", test.name, err)
+		}
+		c.Close()
+	}
+}
+
+func TestServerAuthIdentity(t *testing.T) {
+	whoami := func(conn *smtp.Conn, arg string, session smtp.Session) error {
+		state := conn.State()
+		if state.Auth == nil {
+			conn.WriteResponse(250, smtp.EnhancedCode{2, 0, 0}, "anonymous")
+		} else {
+			conn.WriteResponse(250, smtp.EnhancedCode{2, 0, 0}, state.Auth.Mechanism+" "+state.Auth.Username+" "+state.Auth.Identity)
+		}
+		return nil
+	}
+	_, s, c, _ := testServer(t, func(s *smtp.Server) {
+		s.Backend = &authBackend{s.Backend.(*backend)}
+		s.RegisterCommand("XWHOAMI", whoami)
+	})
+	defer s.Close()
+	authzAddr := c.RemoteAddr().String()
+	c.Close()
+
+	// Without AuthzBackend, PLAIN only accepts the username as identity
+	_, s, c, _ = testServer(t, func(s *smtp.Server) {
+		s.RegisterCommand("XWHOAMI", whoami)
+	})
+	defer s.Close()
+	addr := c.RemoteAddr().String()
+	c.Close()
+
+	tests := []struct {
+		name     string
+		addr     string
+		identity string
+		password string
+		want     string
+	}{
+		{"no identity", authzAddr, "", "password", "PLAIN username username"},
+		{"same identity", authzAddr, "username", "password", "PLAIN username username"},
+		{"allowed identity", authzAddr, "shared", "password", "PLAIN username shared"},
+		{"forbidden identity", authzAddr, "postmaster", "password", "anonymous"},
+		{"invalid password", authzAddr, "shared", "wrong", "anonymous"},
+		{"no AuthzBackend", addr, "shared", "password", "anonymous"},
+		{"no AuthzBackend, same identity", addr, "username", "password", "PLAIN username username"},
+	}
+	for _, test := range tests {
+		c, err := net.Dial("tcp", test.addr)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		scanner := bufio.NewScanner(c)
+		scanner.Scan()
+		io.WriteString(c, "EHLO localhost\r\n")
+		for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "250 ") {
+		}
+
+		ir := base64.StdEncoding.EncodeToString([]byte(test.identity + "\x00username\x00" + test.password))
+		io.WriteString(c, "AUTH PLAIN "+ir+"\r\n")
+		scanner.Scan()
+
+		io.WriteString(c, "XWHOAMI\r\n")
+		scanner.Scan()
+		if want := "250 2.0.0 " + test.want; scanner.Text() != want {
+			t.Errorf("%v: invalid XWHOAMI response: got %q, want %q", test.name, scanner.Text(), want)
+		}
+		c.Close()
+	}
+}
+
+func TestServerAuthIdentity_SCRAM(t *testing.T) {
+	tests := []struct {
+		name     string
+		be       func(be *backend) smtp.Backend
+		identity string
+		ok       bool
+	}{
+		{"allowed identity", func(be *backend) smtp.Backend { return &authBackend{be} }, "shared", true},
+		{"no AuthzBackend", func(be *backend) smtp.Backend { return newNoAuthzBackend(be) }, "shared", false},
+		{"no AuthzBackend, same identity", func(be *backend) smtp.Backend { return newNoAuthzBackend(be) }, "username", true},
+	}
+	for _, test := range tests {
+		_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+			s.Backend = test.be(s.Backend.(*backend))
+		})
+
+		ir := base64.StdEncoding.EncodeToString([]byte("n,a=" + test.identity + ",n=username,r=rOprNGfwEbeRWgbNEkqO"))
+		io.WriteString(c, "AUTH SCRAM-SHA-256 "+ir+"\r\n")
+		scanner.Scan()
+		if ok := strings.HasPrefix(scanner.Text(), "334 "); ok != test.ok {
+			t.Errorf("%v: invalid AUTH response: %v", test.name, scanner.Text())
+		} else if !ok && !strings.HasPrefix(scanner.Text(), "454 4.7.0 ") {
+			t.Errorf("%v: invalid AUTH response: %v", test.name, scanner.Text())
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServerAuthMechanisms_XOAUTH2Error(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.Backend = &authBackend{s.Backend.(*backend)}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	ir := base64.StdEncoding.EncodeToString([]byte("user=username\x01auth=Bearer wrong\x01\x01"))
+	io.WriteString(c, "AUTH XOAUTH2 "+ir+"\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "334 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	io.WriteString(c, "\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "535 5.7.8 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+}
+
+func (be *authBackend) ExternalLogin(state *smtp.ConnectionState, identity string, cert *x509.Certificate) (smtp.Session, error) {
+	if cert.Subject.CommonName != "relay.example.org" || (identity != "" && identity != "relay") {
+		return nil, smtp.ErrAuthFailed
+	}
+	return be.Login(state, "username", "password")
+}
+
+// testCertificate generates a self-signed certificate which can be used by
+// both clients and servers.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "relay.example.org"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestServerAuthExternal(t *testing.T) {
+	cert, pool := testCertificate(t)
+	testServerExternal := func(be func(be *backend) smtp.Backend) (*smtp.Server, string) {
+		_, s, c, _ := testServer(t, func(s *smtp.Server) {
+			s.Backend = be(s.Backend.(*backend))
+			s.TLSConfig = &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+				ClientCAs:    pool,
+			}
+		})
+		addr := c.RemoteAddr().String()
+		c.Close()
+		return s, addr
+	}
+	s, authzAddr := testServerExternal(func(be *backend) smtp.Backend { return &authBackend{be} })
+	defer s.Close()
+	// Without AuthzBackend, no authorization identity is accepted
+	s, addr := testServerExternal(func(be *backend) smtp.Backend { return newNoAuthzBackend(be) })
+	defer s.Close()
+
+	tests := []struct {
+		name       string
+		addr       string
+		clientCert bool
+		identity   string
+		ok         bool
+	}{
+		{"no certificate", authzAddr, false, "", false},
+		{"certificate", authzAddr, true, "", true},
+		{"authorization identity", authzAddr, true, "relay", true},
+		{"invalid authorization identity", authzAddr, true, "postmaster", false},
+		{"no AuthzBackend", addr, true, "", true},
+		{"no AuthzBackend, authorization identity", addr, true, "relay", false},
+	}
+	for _, test := range tests {
+		c, err := smtp.Dial(test.addr)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+
+		config := &tls.Config{ServerName: "localhost", InsecureSkipVerify: true}
+		if test.clientCert {
+			config.Certificates = []tls.Certificate{cert}
+		}
+		if err := c.StartTLS(config); err != nil {
+			t.Fatalf("%v: StartTLS: %v", test.name, err)
+		}
+
+		_, mechs := c.Extension("AUTH")
+		if advertised := strings.Contains(mechs, "EXTERNAL"); advertised != test.clientCert {
+			t.Errorf("%v: invalid AUTH capability: %q", test.name, mechs)
+		}
+
+		err = c.Auth(sasl.NewExternalClient(test.identity))
+		if test.ok && err != nil {
+			t.Errorf("%v: authentication failed: %v", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%v: authentication succeeded", test.name)
+		}
+		c.Close()
+	}
+}